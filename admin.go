@@ -0,0 +1,74 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+)
+
+var adminPage = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta content="width=device-width, initial-scale=1" name="viewport">
+    <meta http-equiv="refresh" content="10">
+    <title>Bypass Admin</title>
+    <link crossorigin="anonymous" href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.7/css/bootstrap.min.css" integrity="sha384-BVYiiSIFeK1dGmJRAkycuHAHRg32OmUcww7on3RYdg4Va+PmSTsz/K68vbdEjh4u" rel="stylesheet">
+</head>
+<body>
+    <div class="container">
+        <div class="page-header">
+            <h1>Bypass Admin</h1>
+        </div>
+        <h2>Upstream Hosts</h2>
+        <table class="table table-condensed">
+            <tr><th>Host</th><th>Breaker</th><th>Failures in a Row</th><th>Requests in Progress</th><th>Last Opened</th><th>Last Error</th></tr>
+            {{range .Upstreams}}
+            <tr{{if eq .State.String "open"}} class="danger"{{else if eq .State.String "half-open"}} class="warning"{{end}}>
+                <td>{{.Host}}</td><td>{{.State}}</td><td>{{.Failures}}</td><td>{{.Active}}</td>
+                <td>{{if not .OpenedAt.IsZero}}{{.OpenedAt.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.LastError}}</td>
+            </tr>
+            {{else}}
+            <tr><td colspan="6">Nothing has been proxied yet.</td></tr>
+            {{end}}
+        </table>
+        <h2>Rate Limits</h2>
+        <table class="table table-condensed">
+            <tr><th>Route</th><th>Clients</th><th>Requests in Progress</th><th>Over Rate Limit</th><th>Over Concurrency Limit</th></tr>
+            {{range .Limiters}}
+            <tr><td>{{.Route}}</td><td>{{.Clients}}</td><td>{{.Active}}</td><td>{{.RateRejected}}</td><td>{{.ConcurrencyRejected}}</td></tr>
+            {{else}}
+            <tr><td colspan="5">No routes are rate limited.</td></tr>
+            {{end}}
+        </table>
+    </div>
+</body>
+</html>
+`))
+
+func adminHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqError { // Handle requests to /admin/, which shows the state of upstream hosts and rate limits
+	if reqHTTP.URL.Path != "/admin/" {
+		return &reqError{nil, "There's nothing here.", 404}
+	}
+
+	type routeStats struct {
+		Route string
+		limiterStats
+	}
+	var limiters []routeStats
+	for route, limiter := range rateLimiters {
+		limiters = append(limiters, routeStats{route, limiter.Stats()})
+	}
+	sort.Slice(limiters, func(i, j int) bool { return limiters[i].Route < limiters[j].Route })
+
+	resWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resWriter.Header().Set("Cache-Control", "no-store")
+	err := adminPage.Execute(resWriter, struct {
+		Upstreams []hostStatus
+		Limiters  []routeStats
+	}{upstreamStatuses(), limiters})
+	if err != nil {
+		return &reqError{err, "Couldn't show the admin page.", 500}
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const authCookie = "bypass_auth" // Name of the cookie that holds a signed login session
+
+type authUserKey struct{} // Context key for the name of the user that a request was made by
+
+type authenticator interface { // The authenticator type checks the credentials on a request
+	Authenticate(reqHTTP *http.Request) (string, bool) // Get the user that a request was made by, if it has valid credentials
+	Challenge() string                                 // The WWW-Authenticate challenge for requests that don't, or an empty string if there isn't one
+}
+
+var authenticators []authenticator // Every configured way of authenticating, tried in order
+
+type htpasswdAuth struct { // The htpasswdAuth type checks HTTP basic auth credentials against an htpasswd file of bcrypt hashes
+	Users map[string][]byte // bcrypt hashes by user name
+	Dummy []byte            // Hash to check passwords against for users that don't exist, so that they take as long as users that do
+}
+
+func loadHtpasswd(path string) (*htpasswdAuth, error) { // Load an htpasswd file, which may only hold bcrypt hashes (made with htpasswd -B)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	auth := &htpasswdAuth{Users: make(map[string][]byte)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		split := strings.SplitN(text, ":", 2)
+		if len(split) != 2 || !strings.HasPrefix(split[1], "$2") {
+			return nil, errors.New("auth: line " + strconv.Itoa(line) + " of " + path + " isn't a user with a bcrypt hash")
+		}
+		auth.Users[split[0]] = []byte(split[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	cost := 0
+	for _, hash := range auth.Users { // The dummy hash has to be as slow as the real ones
+		if hashCost, err := bcrypt.Cost(hash); err == nil && hashCost > cost {
+			cost = hashCost
+		}
+	}
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	dummy, err := bcrypt.GenerateFromPassword([]byte(randomString()), cost)
+	if err != nil {
+		return nil, err
+	}
+	auth.Dummy = dummy
+	return auth, nil
+}
+
+func (auth *htpasswdAuth) Authenticate(reqHTTP *http.Request) (string, bool) {
+	user, password, ok := reqHTTP.BasicAuth()
+	if !ok || !auth.Check(user, password) {
+		return "", false
+	}
+	return user, true
+}
+
+func (auth *htpasswdAuth) Check(user string, password string) bool { // Check a user's password
+	hash, ok := auth.Users[user]
+	if !ok {
+		hash = auth.Dummy // Otherwise how long this takes gives away which users exist
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && ok
+}
+
+func (auth *htpasswdAuth) Challenge() string {
+	return `Basic realm="Bypass", charset="UTF-8"`
+}
+
+type bearerAuth struct { // The bearerAuth type checks bearer tokens against a static list
+	Tokens map[string]string // User names by token
+}
+
+func loadBearerTokens(path string) (*bearerAuth, error) { // Load a file of bearer tokens, one per line, optionally followed by the name of the user that they belong to
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	auth := &bearerAuth{Tokens: make(map[string]string)}
+	for _, line := range strings.Split(string(body), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		sum := sha256.Sum256([]byte(fields[0]))
+		user := "token-" + base64.RawURLEncoding.EncodeToString(sum[:6]) // Unnamed tokens still need telling apart (eg. for rate limits), without giving them away
+		if len(fields) > 1 {
+			user = fields[1]
+		}
+		auth.Tokens[fields[0]] = user
+	}
+	if len(auth.Tokens) == 0 {
+		return nil, errors.New("auth: no tokens in " + path)
+	}
+	return auth, nil
+}
+
+func (auth *bearerAuth) Authenticate(reqHTTP *http.Request) (string, bool) {
+	header := reqHTTP.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	given := []byte(strings.TrimSpace(header[7:]))
+	for token, user := range auth.Tokens { // Compare every token in constant time, so that they can't be guessed a byte at a time
+		if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+func (auth *bearerAuth) Challenge() string {
+	return `Bearer realm="Bypass"`
+}
+
+type cookieAuth struct { // The cookieAuth type checks the signed session cookie that the login page sets
+	Key []byte // Key that cookies are signed with
+}
+
+func (auth *cookieAuth) Authenticate(reqHTTP *http.Request) (string, bool) {
+	cookie, err := reqHTTP.Cookie(authCookie)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(auth.sign(parts[0]+"."+parts[1]))) {
+		return "", false
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	return string(user), true
+}
+
+func (auth *cookieAuth) Challenge() string {
+	return "" // Browsers are sent to the login page instead
+}
+
+func (auth *cookieAuth) Cookie(user string, proxyURL string) *http.Cookie { // Make a session cookie for a user who has just logged in
+	value := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(time.Now().Add(config.AuthTTL).Unix(), 10)
+	cookie := &http.Cookie{Name: authCookie, Value: value + "." + auth.sign(value), Path: externalPath(proxyURL), MaxAge: int(config.AuthTTL.Seconds()), HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if externalURL, err := url.Parse(proxyURL); err == nil {
+		cookie.Secure = externalURL.Scheme == "https"
+		if config.IsolateOrigins {
+			cookie.Domain = externalURL.Hostname() // Origin subdomains need the session too
+		}
+	}
+	return cookie
+}
+
+func (auth *cookieAuth) sign(value string) string {
+	mac := hmac.New(sha256.New, auth.Key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func loadCookieKey(path string) ([]byte, error) { // Load the key that session cookies are signed with, or make a new one if there's no path (which logs everyone out when Bypass restarts)
+	if path == "" {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		return key, err
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(key))) < 16 {
+		return nil, errors.New("auth: the cookie key in " + path + " is too short")
+	}
+	return []byte(strings.TrimSpace(string(key))), nil
+}
+
+func requireAuth(area string, handler http.Handler) http.Handler { // Only let authenticated users through to handler, if area (ui, proxy or admin) is protected
+	protected := false
+	for _, protectedArea := range config.AuthAreas {
+		protected = protected || protectedArea == area
+	}
+	if len(authenticators) == 0 || !protected {
+		return handler
+	}
+
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		for _, auth := range authenticators {
+			if user, ok := auth.Authenticate(reqHTTP); ok {
+				stripCredentials(reqHTTP) // Nothing past here gets to see them, so they can't leak upstream
+				requestRecord(reqHTTP).User = user
+				handler.ServeHTTP(resWriter, reqHTTP.WithContext(context.WithValue(reqHTTP.Context(), authUserKey{}, user)))
+				return
+			}
+		}
+
+		if loginSessions != nil && reqHTTP.Method == "GET" && strings.Contains(reqHTTP.Header.Get("Accept"), "text/html") { // Send people (rather than scripts) to the login page
+			externalURL, err := requestExternalURL(reqHTTP)
+			if err != nil {
+				externalURL = config.ExternalURL
+			}
+			loginPage := "/login.html"
+			if oidcAuth != nil { // Single sign-on takes the place of the login page
+				loginPage = "/oidc/login"
+			}
+			next := strings.TrimSuffix(externalPath(externalURL), "/") + reqHTTP.URL.RequestURI() // Origin subdomains send people back to the main host, which redirects them again
+			http.Redirect(resWriter, reqHTTP, strings.TrimSuffix(externalURL, "/")+loginPage+"?next="+url.QueryEscape(next), http.StatusFound)
+			return
+		}
+		for _, auth := range authenticators {
+			if challenge := auth.Challenge(); challenge != "" {
+				resWriter.Header().Add("WWW-Authenticate", challenge)
+			}
+		}
+		http.Error(resWriter, "You need to log in to use Bypass.", http.StatusUnauthorized)
+	})
+}
+
+func stripCredentials(reqHTTP *http.Request) { // Remove Bypass' own credentials from a request
+	reqHTTP.Header.Del("Authorization")
+	reqHTTP.Header.Del("Proxy-Authorization")
+	cookies := reqHTTP.Cookies()
+	reqHTTP.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != authCookie {
+			reqHTTP.AddCookie(cookie)
+		}
+	}
+}
+
+func randomString() string { // Make a random URL-safe string, for things that need to be unguessable
+	random := make([]byte, 24)
+	_, err := rand.Read(random)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(random)
+}
+
+func readSecret(path string) (string, error) { // Read a secret from a file, so that it doesn't show up in the process list
+	if path == "" {
+		return "", nil
+	}
+	secret, err := ioutil.ReadFile(path)
+	return strings.TrimSpace(string(secret)), err
+}
+
+func authUser(reqHTTP *http.Request) string { // Get the user that a request was made by, or an empty string if it wasn't authenticated
+	user, _ := reqHTTP.Context().Value(authUserKey{}).(string)
+	return user
+}
+
+func loginHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqError { // Handle logins from the login page, which posts to /login
+	if reqHTTP.Method != "POST" {
+		return &reqError{nil, "Log in with the form on login.html.", 405}
+	}
+	externalURL, err := requestExternalURL(reqHTTP)
+	if err != nil {
+		return &reqError{err, "Bypass isn't served from this host.", 400}
+	}
+	if !isSameOrigin(reqHTTP, externalURL) {
+		return &reqError{nil, "You can only log in from Bypass' own login page.", 403}
+	}
+
+	next := reqHTTP.PostFormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") { // Only ever redirect within Bypass
+		next = externalPath(externalURL)
+	}
+	user := reqHTTP.PostFormValue("user")
+	if loginUsers == nil || !loginUsers.Check(user, reqHTTP.PostFormValue("password")) {
+		http.Redirect(resWriter, reqHTTP, externalPath(externalURL)+"login.html?failed=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return nil
+	}
+	http.SetCookie(resWriter, loginSessions.Cookie(user, externalURL))
+	http.Redirect(resWriter, reqHTTP, next, http.StatusSeeOther)
+	return nil
+}
+
+func logoutHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqError { // Handle requests to /logout, which clear the session cookie
+	externalURL, err := requestExternalURL(reqHTTP)
+	if err != nil {
+		return &reqError{err, "Bypass isn't served from this host.", 400}
+	}
+	cookie := loginSessions.Cookie("", externalURL)
+	cookie.Value, cookie.MaxAge = "", -1
+	http.SetCookie(resWriter, cookie)
+	http.Redirect(resWriter, reqHTTP, externalPath(externalURL), http.StatusSeeOther) // Which sends them to log in again, if the UI is protected
+	return nil
+}
+
+var loginUsers *htpasswdAuth  // Users that can log in on the login page
+var loginSessions *cookieAuth // Sessions of users that have logged in on the login page
+
+func setupAuth() error { // Set up the authenticators from the auth flags
+	authenticators = nil
+	if config.AuthHtpasswd != "" {
+		users, err := loadHtpasswd(config.AuthHtpasswd)
+		if err != nil {
+			return err
+		}
+		loginUsers = users
+		authenticators = append(authenticators, users)
+	}
+	if config.AuthTokens != "" {
+		tokens, err := loadBearerTokens(config.AuthTokens)
+		if err != nil {
+			return err
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if config.OIDCIssuer != "" {
+		login, err := setupOIDC()
+		if err != nil {
+			return err
+		}
+		oidcAuth = login
+	}
+	if config.AuthLogin || oidcAuth != nil {
+		key, err := loadCookieKey(config.AuthCookieKey)
+		if err != nil {
+			return err
+		}
+		loginSessions = &cookieAuth{Key: key}
+		authenticators = append([]authenticator{loginSessions}, authenticators...) // Cookies are cheap to check, unlike bcrypt hashes
+	}
+	return nil
+}
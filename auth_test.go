@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testHtpasswd(t *testing.T) *htpasswdAuth {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	err = ioutil.WriteFile(path, []byte("# Users\nalice:"+string(hash)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+func TestHtpasswdCheck(t *testing.T) {
+	users := testHtpasswd(t)
+	if !users.Check("alice", "secret") {
+		t.Error("the right password was rejected")
+	}
+	if users.Check("alice", "wrong") {
+		t.Error("the wrong password was accepted")
+	}
+	if users.Check("bob", "secret") || users.Check("bob", "") {
+		t.Error("a user that doesn't exist was accepted")
+	}
+	if cost, err := bcrypt.Cost(users.Dummy); err != nil || cost != bcrypt.MinCost { // So that checking users that don't exist takes as long
+		t.Errorf("the dummy hash has cost %d (%v), want the cost of the real hashes", cost, err)
+	}
+}
+
+func TestLoginRateLimited(t *testing.T) {
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		loginUsers, loginSessions = nil, nil
+	})
+	config.ExternalURL, config.ExternalURLFromRequest = "http://proxy.test/", false
+	loginUsers, loginSessions = testHtpasswd(t), &cookieAuth{Key: []byte("key")}
+	handler := newRouteLimiter("login", limitRule{Rate: 1.0 / 60, Burst: 2}).Wrap(reqHandler(loginHandler))
+
+	login := func(remoteAddr string) int {
+		form := url.Values{"user": {"alice"}, "password": {"guess"}}
+		reqHTTP := httptest.NewRequest("POST", "http://proxy.test/login", strings.NewReader(form.Encode()))
+		reqHTTP.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		reqHTTP.Header.Set("Sec-Fetch-Site", "same-origin")
+		reqHTTP.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, reqHTTP)
+		return recorder.Code
+	}
+	for i := 0; i < 2; i++ {
+		if status := login("192.0.2.1:1234"); status != http.StatusSeeOther {
+			t.Fatalf("attempt %d got status %d, want %d", i+1, status, http.StatusSeeOther)
+		}
+	}
+	if status := login("192.0.2.1:1234"); status != http.StatusTooManyRequests {
+		t.Errorf("an attempt past the burst got status %d, want %d", status, http.StatusTooManyRequests)
+	}
+	if status := login("192.0.2.2:1234"); status != http.StatusSeeOther {
+		t.Errorf("another client got status %d, want %d", status, http.StatusSeeOther)
+	}
+}
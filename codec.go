@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+type urlCodec interface { // The urlCodec type puts the URL of a proxied page into a URL on the proxy, and gets it back out again
+	Encode(target string, session string) (string, error)   // Encode target into the path and query that go after /p/
+	Decode(reqURL *url.URL, session string) (string, error) // Decode the target of a request to /p/
+	Opaque() bool                                           // Whether the target can't be read from (or appended to) its encoded form
+}
+
+var urlCodecs = map[string]urlCodec{ // URL codecs by the name used in the urlformat flag
+	"query":    queryCodec{},
+	"path":     pathCodec{},
+	"readable": readableCodec{},
+}
+
+var codec urlCodec = queryCodec{} // The codec used for every proxied URL
+
+type queryCodec struct{} // The queryCodec type puts base64 encoded (or encrypted) URLs in the u parameter, like /p/?u=aHR0cHM6Ly9leGFtcGxlLmNvbS8=
+
+func (queryCodec) Encode(target string, session string) (string, error) {
+	var encodedurl string
+	if tokenKeys != nil {
+		token, err := tokenKeys.Seal(target, session)
+		if err != nil {
+			return "", err
+		}
+		encodedurl = token
+	} else {
+		encodedurl = base64.StdEncoding.EncodeToString([]byte(target))
+	}
+	return "?" + url.Values{"u": {encodedurl}}.Encode(), nil
+}
+
+func (queryCodec) Decode(reqURL *url.URL, session string) (string, error) {
+	if tokenKeys != nil {
+		return tokenKeys.Open(reqURL.Query().Get("u"), session)
+	}
+	urldec, err := base64.StdEncoding.DecodeString(reqURL.Query().Get("u"))
+	return string(urldec), err
+}
+
+func (queryCodec) Opaque() bool {
+	return true
+}
+
+type pathCodec struct{} // The pathCodec type puts URL-safe base64 encoded (or encrypted) URLs in the path, like /p/aHR0cHM6Ly9leGFtcGxlLmNvbS8
+
+func (pathCodec) Encode(target string, session string) (string, error) {
+	if tokenKeys != nil {
+		return tokenKeys.Seal(target, session) // Tokens are already URL-safe
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(target)), nil
+}
+
+func (pathCodec) Decode(reqURL *url.URL, session string) (string, error) {
+	encodedurl := proxyPathRest(reqURL)
+	if tokenKeys != nil {
+		return tokenKeys.Open(encodedurl, session)
+	}
+	urldec, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encodedurl, "=")) // Padding is optional, in case someone encodes a URL by hand
+	return string(urldec), err
+}
+
+func (pathCodec) Opaque() bool {
+	return true
+}
+
+type readableCodec struct{} // The readableCodec type puts the parts of URLs in the path as they are, like /p/https/example.com/path?q, so that relative URLs resolve without being modified
+
+func (readableCodec) Encode(target string, session string) (string, error) {
+	parsedurl, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if !parsedurl.IsAbs() { // Typed in without a scheme (eg. "example.com/path")
+		parsedurl, err = url.Parse("http://" + target)
+		if err != nil {
+			return "", err
+		}
+	}
+	path := parsedurl.EscapedPath()
+	if !strings.HasPrefix(path, "/") { // Pages at the root need a slash, so that relative URLs on them don't resolve against the scheme
+		path = "/" + path
+	}
+	encodedurl := parsedurl.Scheme + "/" + parsedurl.Host + path // User info is dropped, since browsers won't send it anyway
+	if parsedurl.RawQuery != "" || parsedurl.ForceQuery {
+		encodedurl += "?" + parsedurl.RawQuery
+	}
+	return encodedurl, nil
+}
+
+func (readableCodec) Decode(reqURL *url.URL, session string) (string, error) {
+	parts := strings.SplitN(proxyPathRest(reqURL), "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", errors.New("codec: readable URLs must look like /p/<scheme>/<host>/<path>")
+	}
+	target := parts[0] + "://" + parts[1] + "/"
+	if len(parts) == 3 {
+		target += parts[2]
+	}
+	if reqURL.RawQuery != "" || reqURL.ForceQuery {
+		target += "?" + reqURL.RawQuery
+	}
+	return target, nil
+}
+
+func (readableCodec) Opaque() bool {
+	return false
+}
+
+func proxyPathRest(reqURL *url.URL) string { // Get the part of a request's path after /p/, still escaped
+	path := reqURL.EscapedPath()
+	if i := strings.Index(path, "/p/"); i >= 0 {
+		return path[i+len("/p/"):]
+	}
+	return ""
+}
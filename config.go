@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var flagAliases = map[string]string{ // Clearer names for flags whose names don't say what they do, which work everywhere the old names do
+	"modify-html":               "HTML",
+	"modify-css":                "css",
+	"modify-js":                 "js",
+	"modify-json":               "json",
+	"modify-xml":                "xml",
+	"modify-media":              "media",
+	"modify-manifests":          "manifest",
+	"strip-csp":                 "cors",
+	"strip-frame-options":       "frameoptions",
+	"strip-integrity":           "integrity",
+	"cache-static":              "cachestatic",
+	"public-dir":                "pubdir",
+	"rewrite-depth":             "rewritedepth",
+	"service-worker":            "serviceworker",
+	"external-url":              "exturl",
+	"external-hosts":            "exthosts",
+	"external-url-from-request": "exturl-from-request",
+	"base-path":                 "basepath",
+	"url-format":                "urlformat",
+}
+
+var settingChoices = map[string][]string{ // Settings that can only be one of a few values
+	"urlformat":         {"query", "path", "readable"},
+	"log-format":        {"text", "json"},
+	"log-level":         {"debug", "info", "warn", "error"},
+	"log-redact":        {"none", "query", "host", "all"},
+	"access-log-format": {"clf", "json"},
+	"trace-extract":     {"none", "trusted", "all"},
+	"auth-protect":      {"ui", "proxy", "admin"}, // A list, where every item has to be one of these
+}
+
+type settingError struct { // The settingError type is a problem with a setting, along with where it was set
+	Source string // Where the setting came from (eg. bypass.yaml:12, BYPASS_PORT or -port)
+	Err    error
+}
+
+func (err settingError) Error() string {
+	return err.Source + ": " + err.Err.Error()
+}
+
+var settingSources = make(map[string]string) // Where each setting that isn't a default came from, by flag name
+
+func defineFlagAliases() { // Make every alias a flag that shares its value with the flag it's an alias of
+	for alias, name := range flagAliases {
+		original := flag.Lookup(name)
+		flag.Var(original.Value, alias, original.Usage+" (same as -"+name+")")
+	}
+}
+
+func canonicalFlag(name string) string { // Get the name of the flag that an alias is for
+	if original, ok := flagAliases[name]; ok {
+		return original
+	}
+	return name
+}
+
+func envName(name string) string { // Get the environment variable that overrides a flag (eg. BYPASS_AUTH_TTL for auth-ttl)
+	return "BYPASS_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func loadConfiguration(path string) []error { // Fill in the settings that weren't given as flags from the config file at path (if there is one), and then from BYPASS_* environment variables
+	flag.Visit(func(f *flag.Flag) {
+		settingSources[canonicalFlag(f.Name)] = "-" + f.Name
+	})
+	fromCommandLine := make(map[string]bool)
+	for name := range settingSources {
+		fromCommandLine[name] = true
+	}
+
+	var errs []error
+	if path != "" {
+		errs = append(errs, loadConfigFile(path, fromCommandLine)...)
+	}
+	flag.VisitAll(func(f *flag.Flag) { // The environment overrides the config file, but not the command line
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" || fromCommandLine[canonicalFlag(f.Name)] {
+			return
+		}
+		err := setFlag(f.Name, value)
+		if err != nil {
+			errs = append(errs, settingError{envName(f.Name), err})
+			return
+		}
+		settingSources[canonicalFlag(f.Name)] = envName(f.Name)
+	})
+	return errs
+}
+
+func loadConfigFile(path string, skip map[string]bool) []error { // Set every flag named in a YAML config file, except for those in skip
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	var document yaml.Node
+	err = yaml.Unmarshal(data, &document)
+	if err != nil {
+		return []error{settingError{path, err}} // The YAML error says which line it's on
+	}
+	if len(document.Content) == 0 { // An empty file
+		return nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return []error{settingError{path + ":" + strconv.Itoa(root.Line), errors.New("the config file should be a mapping of setting names to values")}}
+	}
+
+	var errs []error
+	seen := make(map[string]int) // Line that each setting was first set on
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, valueNode := root.Content[i], root.Content[i+1]
+		source := path + ":" + strconv.Itoa(key.Line)
+		if flag.Lookup(key.Value) == nil || key.Value == "config" {
+			errs = append(errs, settingError{source, errors.New("unknown setting " + strconv.Quote(key.Value))})
+			continue
+		}
+		name := canonicalFlag(key.Value)
+		if line, ok := seen[name]; ok {
+			errs = append(errs, settingError{source, fmt.Errorf("%s was already set on line %d", key.Value, line)})
+			continue
+		}
+		seen[name] = key.Line
+
+		value, err := settingValue(valueNode)
+		if err != nil {
+			errs = append(errs, settingError{path + ":" + strconv.Itoa(valueNode.Line), fmt.Errorf("%s: %v", key.Value, err)})
+			continue
+		}
+		if skip[name] {
+			continue
+		}
+		err = setFlag(key.Value, value)
+		if err != nil {
+			errs = append(errs, settingError{path + ":" + strconv.Itoa(valueNode.Line), fmt.Errorf("%s: %v", key.Value, err)})
+			continue
+		}
+		settingSources[name] = source
+	}
+	return errs
+}
+
+func setFlag(name string, value string) error { // Set a flag, with a clearer error than flag's parse error for values of the wrong type
+	err := flag.Set(name, value)
+	if err != nil && strings.Contains(err.Error(), "parse error") {
+		defaultValue := flag.Lookup(name).DefValue
+		if boolFlag, ok := flag.Lookup(name).Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+			return errors.New(strconv.Quote(value) + " isn't true or false")
+		}
+		return errors.New(strconv.Quote(value) + " isn't valid (the default is " + strconv.Quote(defaultValue) + ")")
+	}
+	return err
+}
+
+func settingValue(node *yaml.Node) (string, error) { // Turn a YAML value into what its flag would be given on the command line
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode: // Lists are comma separated
+		var items []string
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("list items can't be lists or mappings")
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	case yaml.MappingNode: // Mappings become name=value pairs (eg. for schemes and rate limits)
+		var pairs []string
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Kind != yaml.ScalarNode {
+				return "", errors.New("mapping values can't be lists or mappings")
+			}
+			pairs = append(pairs, node.Content[i].Value+"="+node.Content[i+1].Value)
+		}
+		return strings.Join(pairs, ","), nil
+	}
+	return "", errors.New("unsupported value")
+}
+
+func validateConfiguration() []error { // Check that the settings make sense together, beyond each of them being valid by itself
+	var errs []error
+	invalid := func(name string, err error) {
+		source, ok := settingSources[name]
+		if !ok {
+			source = "-" + name + " (default)"
+		}
+		errs = append(errs, settingError{source, err})
+	}
+
+	names := make([]string, 0, len(settingChoices))
+	for name := range settingChoices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		choices := settingChoices[name]
+		values := []string{flag.Lookup(name).Value.String()}
+		_, isList := flag.Lookup(name).Value.(*stringList)
+		if isList {
+			values = strings.Split(values[0], ",")
+		}
+		for _, value := range values {
+			valid := false
+			for _, choice := range choices {
+				valid = valid || value == choice
+			}
+			if !valid && (value != "" || !isList) { // An empty list is fine, but an empty choice isn't
+				invalid(name, errors.New(strconv.Quote(value)+" isn't one of "+strings.Join(choices, ", ")))
+			}
+		}
+	}
+
+	if config.TokenKeyFile != "" && config.URLFormat == "readable" {
+		invalid("token-keys", errors.New("encrypted URLs can't be used with the readable URL format"))
+	}
+	if config.AuthLogin && config.AuthHtpasswd == "" {
+		invalid("auth-login", errors.New("the login page needs an htpasswd file to check passwords against"))
+	}
+	if config.OIDCIssuer != "" && config.OIDCClientID == "" {
+		invalid("oidc-client-id", errors.New("OpenID Connect needs a client ID"))
+	}
+	if config.EnableTLS && config.TLSCertPath == "" {
+		invalid("tls-cert", errors.New("TLS needs a certificate"))
+	}
+	if config.EnableTLS && config.TLSKeyPath == "" {
+		invalid("tls-key", errors.New("TLS needs a private key"))
+	}
+	if config.TraceSampleRatio < 0 || config.TraceSampleRatio > 1 {
+		invalid("trace-sample", errors.New("the fraction of requests to trace has to be between 0 and 1"))
+	}
+	_, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		invalid("trusted-proxies", err)
+	}
+	return errs
+}
+
+func validateFiles() []error { // Check that the files named in the settings can be loaded, without keeping what's loaded
+	var errs []error
+	check := func(name string, path string, load func(string) error) {
+		if path == "" {
+			return
+		}
+		if err := load(path); err != nil {
+			source, ok := settingSources[name]
+			if !ok {
+				source = "-" + name
+			}
+			errs = append(errs, settingError{source, err})
+		}
+	}
+	check("token-keys", config.TokenKeyFile, func(path string) error { _, err := loadTokenKeys(path); return err })
+	check("htpasswd", config.AuthHtpasswd, func(path string) error { _, err := loadHtpasswd(path); return err })
+	check("auth-tokens", config.AuthTokens, func(path string) error { _, err := loadBearerTokens(path); return err })
+	check("auth-cookie-key", config.AuthCookieKey, func(path string) error { _, err := loadCookieKey(path); return err })
+	check("oidc-client-secret", config.OIDCClientSecret, func(path string) error { _, err := readSecret(path); return err })
+	check("tls-cert", config.TLSCertPath, func(path string) error { _, err := os.Stat(path); return err })
+	check("tls-key", config.TLSKeyPath, func(path string) error { _, err := os.Stat(path); return err })
+	return errs
+}
+
+func configCommand(args []string) int { // Run bypass config validate [path], returning the exit code
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: bypass [flags] config validate [path to config file]")
+		return 2
+	}
+	path := configPath()
+	if len(args) > 1 {
+		path = args[1]
+	}
+
+	errs := loadConfiguration(path)
+	errs = append(errs, validateConfiguration()...)
+	errs = append(errs, validateFiles()...)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("The configuration is valid")
+	return 0
+}
+
+func configPath() string { // Get the path of the config file, which can't come from the config file itself
+	if config.ConfigFile != "" {
+		return config.ConfigFile
+	}
+	return os.Getenv(envName("config"))
+}
+
+func setupConfiguration() { // Load and check the configuration, exiting if there's anything wrong with it
+	errs := loadConfiguration(configPath())
+	errs = append(errs, validateConfiguration()...)
+	errs = append(errs, validateFiles()...) // So that a missing file is reported along with where it was set
+	for _, err := range errs {
+		slog.Error("invalid configuration", "error", err.Error())
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
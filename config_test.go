@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+type testSettings struct { // The testSettings type holds the flags that setupTestFlags defines
+	Port    string
+	HTML    bool
+	Hosts   stringList
+	Limit   stringList
+	Timeout string
+}
+
+func setupTestFlags(t *testing.T, args ...string) *testSettings { // Replace the command line flags with a few test ones parsed from args, undoing it when the test is over
+	savedFlags, savedSources := flag.CommandLine, settingSources
+	t.Cleanup(func() { flag.CommandLine, settingSources = savedFlags, savedSources })
+	settingSources = make(map[string]string)
+
+	settings := &testSettings{}
+	flag.CommandLine = flag.NewFlagSet("bypass", flag.ContinueOnError)
+	flag.StringVar(&settings.Port, "port", "8000", "port")
+	flag.BoolVar(&settings.HTML, "HTML", false, "modify HTML")
+	flag.Var(flag.Lookup("HTML").Value, "modify-html", "modify HTML (same as -HTML)") // One of flagAliases
+	flag.Var(&settings.Hosts, "exthosts", "external hosts")
+	flag.Var(&settings.Limit, "limit-proxy", "rate limit")
+	flag.StringVar(&settings.Timeout, "auth-ttl", "24h", "session lifetime")
+	flag.String("config", "", "config file")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return settings
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "bypass.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func fromFile(source string, path string) string { // Replace the path of the config file in a source or error with bypass.yaml
+	if path == "" {
+		return source
+	}
+	return strings.Replace(source, path, "bypass.yaml", -1)
+}
+
+func errorStrings(errs []error) string {
+	var lines []string
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    string // Value of BYPASS_PORT, if it's set
+		file   string
+		port   string
+		source string // Where the port is reported to have come from, with bypass.yaml standing for the file's path
+	}{
+		{"default", nil, "", "", "8000", ""},
+		{"file", nil, "", "port: 8080\n", "8080", "bypass.yaml:1"},
+		{"environment over file", nil, "9090", "port: 8080\n", "9090", "BYPASS_PORT"},
+		{"flag over environment and file", []string{"-port", "7070"}, "9090", "port: 8080\n", "7070", "-port"},
+		{"flag over file", []string{"-port", "7070"}, "", "\nport: 8080\n", "7070", "-port"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := setupTestFlags(t, test.args...)
+			if test.env != "" {
+				t.Setenv("BYPASS_PORT", test.env)
+			}
+			path := ""
+			if test.file != "" {
+				path = writeConfigFile(t, test.file)
+			}
+			if errs := loadConfiguration(path); len(errs) > 0 {
+				t.Fatal(errorStrings(errs))
+			}
+			if settings.Port != test.port {
+				t.Errorf("port is %q, want %q", settings.Port, test.port)
+			}
+			if source := fromFile(settingSources["port"], path); source != test.source {
+				t.Errorf("port came from %q, want %q", source, test.source)
+			}
+		})
+	}
+}
+
+func TestConfigAliases(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		file   string
+		html   bool
+		source string
+	}{
+		{"alias in file", nil, nil, "modify-html: true\n", true, "bypass.yaml:1"},
+		{"original in file", nil, nil, "HTML: true\n", true, "bypass.yaml:1"},
+		{"alias in environment", nil, map[string]string{"BYPASS_MODIFY_HTML": "true"}, "", true, "BYPASS_MODIFY_HTML"},
+		{"alias flag over file", []string{"-modify-html=false"}, nil, "HTML: true\n", false, "-modify-html"},
+		{"original flag over alias in environment", []string{"-HTML=false"}, map[string]string{"BYPASS_MODIFY_HTML": "true"}, "", false, "-HTML"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := setupTestFlags(t, test.args...)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			path := ""
+			if test.file != "" {
+				path = writeConfigFile(t, test.file)
+			}
+			if errs := loadConfiguration(path); len(errs) > 0 {
+				t.Fatal(errorStrings(errs))
+			}
+			if settings.HTML != test.html {
+				t.Errorf("HTML is %v, want %v", settings.HTML, test.html)
+			}
+			if source := fromFile(settingSources["HTML"], path); source != test.source {
+				t.Errorf("HTML came from %q, want %q", source, test.source)
+			}
+		})
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		errs []string // Errors that should be reported, with bypass.yaml standing for the file's path
+	}{
+		{"unknown key", "port: 8080\nfrobnicate: true\n", []string{`bypass.yaml:2: unknown setting "frobnicate"`}},
+		{"config key", "config: other.yaml\n", []string{`bypass.yaml:1: unknown setting "config"`}},
+		{"duplicate key", "port: 8080\nHTML: true\nport: 9090\n", []string{"bypass.yaml:3: port was already set on line 1"}},
+		{"duplicate through an alias", "HTML: true\nmodify-html: false\n", []string{"bypass.yaml:2: modify-html was already set on line 1"}},
+		{"wrong type", "port: 8080\n\nHTML: sometimes\n", []string{`bypass.yaml:3: HTML: "sometimes" isn't true or false`}},
+		{"nested list", "exthosts:\n  - [a, b]\n", []string{"bypass.yaml:2: exthosts: list items can't be lists or mappings"}},
+		{"not a mapping", "- port\n", []string{"bypass.yaml:1: the config file should be a mapping of setting names to values"}},
+		{"every error", "frobnicate: 1\nport: 1\nport: 2\n", []string{`bypass.yaml:1: unknown setting "frobnicate"`, "bypass.yaml:3: port was already set on line 2"}},
+		{"empty", "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestFlags(t)
+			path := writeConfigFile(t, test.file)
+			errs := loadConfiguration(path)
+			got := fromFile(errorStrings(errs), path)
+			if want := strings.Join(test.errs, "\n"); got != want {
+				t.Errorf("got errors:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigFileSyntaxError(t *testing.T) {
+	setupTestFlags(t)
+	path := writeConfigFile(t, "port: 8080\n\tHTML: true\n")
+	errs := loadConfiguration(path)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), path+": ") || !strings.Contains(errs[0].Error(), "line 2") {
+		t.Errorf("got %q, want a YAML error on line 2", errorStrings(errs))
+	}
+}
+
+func TestEnvironmentNames(t *testing.T) {
+	settings := setupTestFlags(t)
+	t.Setenv("BYPASS_AUTH_TTL", "1h")
+	t.Setenv("BYPASS_CONFIG", "ignored.yaml") // Only read by configPath
+	if errs := loadConfiguration(""); len(errs) > 0 {
+		t.Fatal(errorStrings(errs))
+	}
+	if settings.Timeout != "1h" || settingSources["auth-ttl"] != "BYPASS_AUTH_TTL" {
+		t.Errorf("auth-ttl is %q from %q, want 1h from BYPASS_AUTH_TTL", settings.Timeout, settingSources["auth-ttl"])
+	}
+	if _, ok := settingSources["config"]; ok {
+		t.Error("config was set from the environment")
+	}
+}
+
+func TestEnvironmentErrors(t *testing.T) {
+	setupTestFlags(t)
+	t.Setenv("BYPASS_HTML", "sometimes")
+	errs := loadConfiguration("")
+	if want := `BYPASS_HTML: "sometimes" isn't true or false`; errorStrings(errs) != want {
+		t.Errorf("got %q, want %q", errorStrings(errs), want)
+	}
+}
+
+func TestSettingValue(t *testing.T) {
+	tests := []struct {
+		yaml  string
+		value string // Empty if it can't be a setting
+		err   bool
+	}{
+		{"8080", "8080", false},
+		{"'quoted, with a comma'", "quoted, with a comma", false},
+		{"~", "", false},
+		{"[a.example, b.example]", "a.example,b.example", false},
+		{"- a.example\n- b.example\n", "a.example,b.example", false},
+		{"[]", "", false},
+		{"rate: 10/s\nburst: 20\n", "rate=10/s,burst=20", false},
+		{"{javascript: neutralize, '*': block}", "javascript=neutralize,*=block", false},
+		{"hosts: &hosts [a, b]\nother: *hosts\n", "", true}, // A mapping of lists
+		{"[[a, b]]", "", true},
+		{"[{a: b}]", "", true},
+	}
+	for _, test := range tests {
+		var document yaml.Node
+		if err := yaml.Unmarshal([]byte(test.yaml), &document); err != nil {
+			t.Fatal(err)
+		}
+		value, err := settingValue(document.Content[0])
+		if (err != nil) != test.err || value != test.value {
+			t.Errorf("%q: got %q (%v), want %q", test.yaml, value, err, test.value)
+		}
+	}
+}
+
+func TestSettingValueAlias(t *testing.T) {
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte("hosts: &hosts [a, b]\nexthosts: *hosts\n"), &document); err != nil {
+		t.Fatal(err)
+	}
+	value, err := settingValue(document.Content[0].Content[3])
+	if err != nil || value != "a,b" {
+		t.Errorf("got %q (%v), want the anchored list", value, err)
+	}
+}
+
+func TestConfigFileMappingsAndLists(t *testing.T) {
+	settings := setupTestFlags(t)
+	path := writeConfigFile(t, "exthosts: [a.example, b.example]\nlimit-proxy:\n  rate: 10/s\n  burst: 20\n")
+	if errs := loadConfiguration(path); len(errs) > 0 {
+		t.Fatal(errorStrings(errs))
+	}
+	if settings.Hosts.String() != "a.example,b.example" {
+		t.Errorf("exthosts is %q", settings.Hosts.String())
+	}
+	if settings.Limit.String() != "rate=10/s,burst=20" {
+		t.Errorf("limit-proxy is %q", settings.Limit.String())
+	}
+}
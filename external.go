@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var trustedProxies []*net.IPNet // Networks of reverse proxies that we trust the X-Forwarded-* headers of
+
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) { // Parse a list of IPs and CIDR ranges
+	var networks []*net.IPNet
+	for _, item := range list {
+		if !strings.Contains(item, "/") { // A single IP
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("external: " + item + " isn't a valid IP or CIDR range")
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.New("external: " + item + " isn't a valid IP or CIDR range")
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(remoteAddr string) bool { // Check if a request came from one of the trusted reverse proxies
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIP(reqHTTP *http.Request) string { // Get the IP of the client that made a request, looking past trusted reverse proxies
+	ip, _, err := net.SplitHostPort(reqHTTP.RemoteAddr)
+	if err != nil {
+		ip = reqHTTP.RemoteAddr
+	}
+	if !isTrustedProxy(reqHTTP.RemoteAddr) {
+		return ip
+	}
+	hops := strings.Split(reqHTTP.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- { // Each proxy appends the address that it got the request from, so the first untrusted one from the end is the client
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func requestExternalURL(reqHTTP *http.Request) (string, error) { // Get the external URL of the proxy that a request was made to, which formatted URLs should point back to
+	if !config.ExternalURLFromRequest {
+		return config.ExternalURL, nil
+	}
+	externalURL, err := url.Parse(config.ExternalURL) // The path still comes from the exturl flag
+	if err != nil {
+		return "", err
+	}
+
+	scheme, host := "http", reqHTTP.Host
+	if reqHTTP.TLS != nil {
+		scheme = "https"
+	}
+	if isTrustedProxy(reqHTTP.RemoteAddr) {
+		if proto := firstForwardedValue(reqHTTP.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwardedHost := firstForwardedValue(reqHTTP.Header.Get("X-Forwarded-Host")); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+
+	host = strings.ToLower(host)
+	if !isExternalHost(host) {
+		if i := strings.IndexByte(host, '.'); config.IsolateOrigins && i >= 0 && isExternalHost(host[i+1:]) { // A request to an origin subdomain
+			host = host[i+1:]
+		} else {
+			return "", errors.New("external: " + host + " isn't an allowed external host")
+		}
+	}
+	externalURL.Scheme = scheme
+	externalURL.Host = host
+	return externalURL.String(), nil
+}
+
+func externalPath(proxyURL string) string { // Get the path that Bypass is served under at an external URL, with a trailing slash
+	parsedurl, err := url.Parse(proxyURL)
+	if err != nil {
+		return "/"
+	}
+	return strings.TrimSuffix(parsedurl.Path, "/") + "/"
+}
+
+func mountUnder(basePath string, handler http.Handler) http.Handler { // Serve handler under a path prefix, as if it were at the root
+	basePath = "/" + strings.Trim(basePath, "/")
+	stripped := http.StripPrefix(basePath, handler)
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		if reqHTTP.URL.Path == basePath { // Relative links on the UI only work with a trailing slash
+			http.Redirect(resWriter, reqHTTP, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(reqHTTP.URL.Path, basePath+"/") { // Don't let /prefixfoo match /prefix
+			http.NotFound(resWriter, reqHTTP)
+			return
+		}
+		stripped.ServeHTTP(resWriter, reqHTTP)
+	})
+}
+
+func isExternalHost(host string) bool { // Check if a host (with or without a port) is one that Bypass can be reached at
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, allowed := range config.ExternalHosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == host || allowed == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+func firstForwardedValue(header string) string { // Get the value added by the proxy closest to the client, when several proxies have appended to a header
+	return strings.ToLower(strings.TrimSpace(strings.Split(header, ",")[0]))
+}
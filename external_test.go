@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMountUnder(t *testing.T) {
+	var seenPath string
+	handler := mountUnder("/tools/bypass/", http.HandlerFunc(func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		seenPath = reqHTTP.URL.Path
+	}))
+	tests := []struct {
+		path     string
+		status   int
+		seen     string // Path that the mounted handler sees, if it's reached
+		location string // Where the request is redirected to, if it is
+	}{
+		{"/tools/bypass", http.StatusMovedPermanently, "", "/tools/bypass/"},
+		{"/tools/bypass/", http.StatusOK, "/", ""},
+		{"/tools/bypass/index.html", http.StatusOK, "/index.html", ""},
+		{"/tools/bypass/p/", http.StatusOK, "/p/", ""},
+		{"/tools/bypass/p/aHR0cHM6Ly9leGFtcGxlLmNvbS8/a/b", http.StatusOK, "/p/aHR0cHM6Ly9leGFtcGxlLmNvbS8/a/b", ""},
+		{"/tools/bypassfoo", http.StatusNotFound, "", ""},
+		{"/tools/bypassfoo/p/", http.StatusNotFound, "", ""},
+		{"/tools/", http.StatusNotFound, "", ""},
+		{"/p/", http.StatusNotFound, "", ""},
+	}
+	for _, test := range tests {
+		seenPath = ""
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://proxy.test"+test.path, nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.path, recorder.Code, test.status)
+		}
+		if seenPath != test.seen {
+			t.Errorf("%s: handler saw %q, want %q", test.path, seenPath, test.seen)
+		}
+		if location := recorder.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: redirected to %q, want %q", test.path, location, test.location)
+		}
+	}
+}
+
+func setupPrefixedLogin(t *testing.T) { // Serve Bypass under /tools/bypass with the login page, undoing it when the test is over
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		loginUsers, loginSessions, authenticators = nil, nil, nil
+	})
+	config.ExternalURL, config.ExternalURLFromRequest, config.BasePath = "http://proxy.test/tools/bypass", false, "/tools/bypass"
+	config.AuthAreas = stringList{"ui", "proxy"}
+	loginUsers = &htpasswdAuth{Users: map[string][]byte{}}
+	loginSessions = &cookieAuth{Key: []byte("key")}
+	authenticators = []authenticator{loginSessions, loginUsers}
+}
+
+func TestLoginNextUnderPrefix(t *testing.T) {
+	setupPrefixedLogin(t)
+	handler := mountUnder(config.BasePath, requireAuth("proxy", http.NotFoundHandler()))
+
+	reqHTTP := httptest.NewRequest("GET", "http://proxy.test/tools/bypass/p/?u=abc", nil)
+	reqHTTP.Header.Set("Accept", "text/html")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, reqHTTP)
+	want := "http://proxy.test/tools/bypass/login.html?next=" + url.QueryEscape("/tools/bypass/p/?u=abc")
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != want {
+		t.Errorf("got status %d to %q, want %d to %q", recorder.Code, recorder.Header().Get("Location"), http.StatusFound, want)
+	}
+}
+
+func TestFailedLoginUnderPrefix(t *testing.T) {
+	setupPrefixedLogin(t)
+	handler := mountUnder(config.BasePath, reqHandler(loginHandler))
+
+	form := url.Values{"user": {"nobody"}, "password": {"wrong"}, "next": {"/tools/bypass/p/?u=abc"}}
+	reqHTTP := httptest.NewRequest("POST", "http://proxy.test/tools/bypass/login", strings.NewReader(form.Encode()))
+	reqHTTP.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	reqHTTP.Header.Set("Sec-Fetch-Site", "same-origin")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, reqHTTP)
+	want := "/tools/bypass/login.html?failed=1&next=" + url.QueryEscape("/tools/bypass/p/?u=abc")
+	if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != want {
+		t.Errorf("got status %d to %q, want %d to %q", recorder.Code, recorder.Header().Get("Location"), http.StatusSeeOther, want)
+	}
+}
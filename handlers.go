@@ -1,20 +1,24 @@
 package main
 
 import (
-	"encoding/base64"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"runtime"
 	"strings"
+	"time"
 
-	"golang.org/x/net/html"
-
-	"github.com/PuerkitoBio/goquery"
-	"github.com/lukasbob/srcset"
 	goenc "github.com/mattn/go-encoding"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type reqError struct {
@@ -24,50 +28,68 @@ type reqError struct {
 }
 
 type proxy struct { // The Proxy type holds request and response details for the proxy request
-	RawURL        string            // Raw URL that is formatted into URL
-	ReqURL        *url.URL          // Formatted URL as the URL type
-	FinalURL      string            // Formatted URL as a string
-	Body          []byte            // The request Body as a byte slice
-	ConType       *contentType      // Content type as parsed into the ContentType type
-	Document      *goquery.Document // The body parsed into the Document type
-	FormattedBody string            // The final formatted body, converted into the a string form Document
+	RawURL   string        // Raw URL that is formatted into URL
+	ReqURL   *url.URL      // Formatted URL as the URL type
+	FinalURL string        // Formatted URL as a string
+	Body     *bufio.Reader // The response Body, buffered so that we can sniff its content type without reading all of it
+	ConType  *contentType  // Content type as parsed into the ContentType type
 }
 
 var err error
 
+var cssURLRegexp = regexp.MustCompile(`url(?:\(['"]?)(.*?)(?:['"]?\))`) // Regular expression for matching "url()" contents in CSS
+
 func proxyHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqError { // Handle requests to /p/
 	defer func() { // Recover from a panic if one occurred
 		if err := recover(); err != nil {
-			fmt.Println(err)
+			requestLogger(reqHTTP).Error("recovered from a panic", "panic", err)
 			fmt.Fprint(resWriter, err)
 		}
 	}()
 
 	var prox proxy
-	urlRegexp := regexp.MustCompile(`url(?:\(['"]?)(.*?)(?:['"]?\))`) // Regular expression for matching "url()" contents in CSS
 
-	replFunc := func(origURI string) string {
-		submatch := urlRegexp.FindStringSubmatch(origURI)[1]                // This is how we get the regex's capture group (we get google.com out of url("google.com)
-		fURI, err := formatURI(submatch, prox.FinalURL, config.ExternalURL) // Fully format the URI
-		if err != nil {
-			fmt.Println(err)
-			return origURI // If we can't format it just return the original
-		}
-		return "url('" + fURI + "')" // We also need to add the url() part back in
+	if config.BlockOriginServiceWorkers && reqHTTP.Header.Get("Service-Worker") == "script" { // Browsers send this header when fetching a service worker script
+		return &reqError{nil, "Proxied pages can't register service workers, because they would take over the entire proxy.", 403}
 	}
 
-	urldec, err := base64.StdEncoding.DecodeString(reqHTTP.URL.Query().Get("u"))
+	externalURL, err := requestExternalURL(reqHTTP)
+	if err != nil {
+		return &reqError{err, "Bypass isn't served from this host.", 400}
+	}
+	link := &linkBase{ExternalURL: externalURL, Session: tokenSession(reqHTTP)}
+	record := requestRecord(reqHTTP)
+	record.Proxied = true
+	stages := &stageTracer{}
+	defer stages.End()
+	stages.Next(reqHTTP.Context(), "decode url")
+	prox.RawURL, err = codec.Decode(reqHTTP.URL, link.Session) // Get the value from the url key of a posted form
 	if err != nil {
 		return &reqError{err, "Couldn't decode provided URL parameter.", 400}
 	}
+	record.Target = prox.RawURL
 
-	prox.RawURL = string(urldec) // Get the value from the url key of a posted form
+	if suffix := reqHTTP.URL.Query().Get("s"); suffix != "" && codec.Opaque() { // DASH segment templates put the part of the URL that the player fills in here
+		encodedURL, err := url.Parse(prox.RawURL)
+		if err != nil {
+			return &reqError{err, "Couldn't parse provided URL.", 400}
+		}
+		prox.RawURL += suffix
+		suffixedURL, err := url.Parse(prox.RawURL)
+		if err != nil || suffixedURL.Host != encodedURL.Host { // The suffix isn't encrypted, so it mustn't be able to change where the request goes
+			return &reqError{err, "The s parameter can't change the host of the provided URL.", 400}
+		}
+	}
 
-	prox.ReqURL, err = url.Parse(prox.RawURL) // Parse the raw URL value we were given into somthing we can work with
+	prox.ReqURL, err = url.Parse(cleanURL(prox.RawURL)) // Parse the raw URL value we were given into somthing we can work with
 	if err != nil {
 		return &reqError{err, "Couldn't parse provided URL.", 400}
 	}
 
+	if prox.ReqURL.IsAbs() && schemePolicyFor(prox.ReqURL.Scheme) != schemeProxy {
+		return &reqError{nil, "Bypass doesn't follow " + prox.ReqURL.Scheme + ": URLs.", 403}
+	}
+
 	if !prox.ReqURL.IsAbs() {
 		prox.ReqURL.Scheme = "http"
 		prox.ReqURL, err = url.Parse(prox.ReqURL.String()) // This is a bit hacky, but it seems to be the only way to get this to work
@@ -80,18 +102,38 @@ func proxyHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqErro
 		}
 	}
 
+	err = normalizeHost(prox.ReqURL) // This has to happen before we check the host, since it may be written in a way that hides what it is (eg. 0x7f.1)
+	if err != nil {
+		return &reqError{err, "Couldn't parse the host of provided URL.", 400}
+	}
+	record.Host = prox.ReqURL.Host
+
+	stages.Next(reqHTTP.Context(), "check url") // Its own stage, since it looks up the host
 	if prox.ReqURL.Port() != "80" && prox.ReqURL.Port() != "443" && prox.ReqURL.Port() != "" {
+		ssrfBlockedTotal.WithLabelValues("port").Inc()
 		return &reqError{nil, "Requests on ports other than 80 and 443 are forbidden to mitigate the possibility of port scanning as a result of the SSRF vulnerability inherent in this application's design.", 403}
 	}
 
 	err = isAllowedURL(prox.ReqURL)
 	if err != nil {
+		stages.Fail(err)
+		ssrfBlockedTotal.WithLabelValues("address").Inc()
 		return &reqError{err, "You cannot request certain special IPs to mitigate the SSRF vulnerability inherent in this application's design.", 403}
 	}
 
-	client := &http.Client{} // Make a new http client
+	if label, _ := requestLabel(reqHTTP, link.ExternalURL); config.IsolateOrigins && label != originLabel(prox.ReqURL) { // Every origin has to be served from its own subdomain
+		http.Redirect(resWriter, reqHTTP, isolatedURL(reqHTTP, link.ExternalURL, prox.ReqURL), http.StatusFound)
+		return nil
+	}
 
-	request, err := http.NewRequest("GET", prox.ReqURL.String(), nil) // Make a new http GET request
+	ctx := reqHTTP.Context() // The upstream request is cancelled if the client goes away
+	if config.UpstreamTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.UpstreamTimeout)
+		defer cancel()
+	}
+	ctx = withConnectionTracing(stages.Next(ctx, "fetch upstream"))
+	request, err := http.NewRequestWithContext(ctx, "GET", prox.ReqURL.String(), nil) // Make a new http GET request
 	if err != nil {
 		return &reqError{err, "Couldn't make a new http request with provided URL.", 400}
 	}
@@ -102,30 +144,56 @@ func proxyHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqErro
 	request.Header.Set("User-Agent", reqHTTP.Header.Get("User-Agent")+" ("+runtime.Version()+") Bypass-Webproxy/1.0 (+https://github.com/pietroglyph/bypass-webproxy)")
 	request.Header.Set("X-Forwarded-For", reqHTTP.RemoteAddr)
 	request.Header.Set("Forwarded", "for="+string(reqHTTP.RemoteAddr))
+	if reqHTTP.Header.Get("Range") != "" { // Media players fetch segments in parts
+		request.Header.Set("Range", reqHTTP.Header.Get("Range"))
+	}
+	injectTraceContext(ctx, request)
 
-	httpCliResp, err := client.Do(request) // Actually do the http request
-	if err != nil {
+	httpCliResp, err := upstreamClient.Do(request) // Actually do the http request
+	stages.Fail(err)
+	var openErr *breakerOpenError
+	if errors.As(err, &openErr) {
+		serveUnavailable(resWriter, openErr)
+		return nil
+	} else if errors.Is(err, errHostBusy) {
+		return &reqError{err, "Too many people are using " + prox.ReqURL.Host + " through Bypass right now, try again in a bit.", 503}
+	} else if err != nil && isTimeout(err) {
+		return &reqError{err, prox.ReqURL.Host + " took too long to respond.", 504}
+	} else if err != nil {
 		return &reqError{err, "Invalid URL, or server connectivity issue.", 400}
 	}
-	prox.Body, err = ioutil.ReadAll(httpCliResp.Body) // Read the response into another variable
-	if err != nil {
+	defer httpCliResp.Body.Close()
+	traceResponse(ctx, httpCliResp)
+	upstreamBody := &timedReader{Reader: httpCliResp.Body}
+	prox.Body = bufio.NewReader(upstreamBody)
+	sniffed, err := prox.Body.Peek(512) // DetectContentType only ever looks at the first 512 bytes
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
 		return &reqError{err, "Couldn't read returned body.", 400}
 	}
 
 	prox.FinalURL = httpCliResp.Request.URL.String() // This accounts for redirects, and gives us the *final* URL
 
+	if config.IsolateOrigins && originLabel(httpCliResp.Request.URL) != originLabel(prox.ReqURL) { // We were redirected to another origin, so send the client to its subdomain instead
+		location, err := formatURI(prox.FinalURL, prox.FinalURL, link)
+		if err != nil {
+			return &reqError{err, "Couldn't format the URL that we were redirected to.", 500}
+		}
+		http.Redirect(resWriter, reqHTTP, location, http.StatusFound)
+		return nil
+	}
+
 	prox.ConType, err = parseContentType(httpCliResp.Header.Get("Content-Type")) // Get the MIME type of what we received from the Content-Type header
 	if err != nil {
-		prox.ConType, err = parseContentType(http.DetectContentType(prox.Body)) // Looks like we couldn't parse the Content-Type header, so we'll have to detect content type from the actual response body
+		prox.ConType, err = parseContentType(http.DetectContentType(sniffed)) // Looks like we couldn't parse the Content-Type header, so we'll have to detect content type from the actual response body
 		if err != nil {
 			return &reqError{err, "Couldn't parse provided or detected content-type of document.", 400}
 		}
 	}
 
 	if prox.ConType.Parameters["charset"] == "" { // Make sure that we have a charset if the website doesn't provide one (which is fairly common)
-		tempConType, err := parseContentType(http.DetectContentType(prox.Body))
+		tempConType, err := parseContentType(http.DetectContentType(sniffed))
 		if err != nil {
-			fmt.Println(err.Error()) // Instead of failing we will just give the user a non-formatted page and print the error
+			requestLogger(reqHTTP).Debug("couldn't detect the charset", "error", err) // Instead of failing we will just give the user a non-formatted page and log the error
 		} else {
 			prox.ConType.Parameters["charset"] = tempConType.Parameters["charset"]
 		}
@@ -150,121 +218,79 @@ func proxyHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqErro
 		case "Content-Length":
 			// This will automatically be written for our modified page by net/http, and we don't want to copy it
 			continue
+		case "Link":
+			for _, value := range httpCliResp.Header[curHeader] { // There can be more than one Link header, and we want all of them
+				resWriter.Header().Add(curHeader, modifyLinkHeader(value, prox.FinalURL, link))
+			}
+			continue
 		}
 		resWriter.Header().Set(curHeader, httpCliResp.Header.Get(curHeader))
 	}
 	resWriter.Header().Set("Access-Control-Allow-Origin", "*") // This always needs to be set
 
-	if prox.ConType.Type == "text" && prox.ConType.Subtype == "html" && prox.ConType.Parameters["charset"] != "" && config.ModifyHTML { // Does it say it's html with a valid charset
-		resReader := strings.NewReader(string(prox.Body))
+	if httpCliResp.StatusCode == http.StatusPartialContent { // We can't modify part of a document, so stream it through untouched
+		stages.Next(reqHTTP.Context(), "stream response")
+		resWriter.WriteHeader(httpCliResp.StatusCode)
+		_, err = io.Copy(resWriter, prox.Body)
+		if err != nil {
+			return &reqError{err, "Couldn't write content to response.", 500}
+		}
+	} else if prox.ConType.Type == "text" && prox.ConType.Subtype == "html" && prox.ConType.Parameters["charset"] != "" && config.ModifyHTML { // Does it say it's html with a valid charset
+		rewriteCtx := stages.Next(reqHTTP.Context(), "rewrite html")
+		var resReader io.Reader = prox.Body
+		var decoded *timedReader
 		if prox.ConType.Parameters["charset"] != "utf-8" {
 			encoding := goenc.GetEncoding(prox.ConType.Parameters["charset"])
 			if encoding == nil {
 				return &reqError{nil, prox.ConType.Parameters["charset"] + " is an invalid encoding.", 400}
 			}
-			fmt.Println(encoding, prox.ConType.Parameters["charset"])
-			decoder := encoding.NewDecoder()
-			prox.Document, err = goquery.NewDocumentFromReader(decoder.Reader(resReader)) // Parse the response from our target website whose body has been freshly utf-8 encoded
-			if err != nil {                                                               // Looks like we can't parse this, let's just spit out the raw response
-				fmt.Fprint(resWriter, string(prox.Body))
-				fmt.Println(err.Error(), prox.ReqURL)
-				return nil
-			}
-		} else {
-			prox.Document, err = goquery.NewDocumentFromReader(resReader)
-			if err != nil { // Looks like we can't parse this, let's just spit out the raw response
-				fmt.Fprint(resWriter, string(prox.Body))
-				fmt.Println(err.Error(), prox.ReqURL)
-				return nil
-			}
+			requestLogger(reqHTTP).Debug("decoding the page", "charset", prox.ConType.Parameters["charset"])
+			decoded = &timedReader{Reader: encoding.NewDecoder().Reader(resReader)} // Make sure that the rewriter gets a freshly utf-8 encoded body
+			resReader = decoded
 		}
-		prox.Document.Find("*[href]").Each(func(i int, s *goquery.Selection) { // Modify all href attributes
-			if len(s.Parent().Nodes) > 0 && s.Parent().Nodes[0].Type == html.ElementNode {
-				if s.Parent().Nodes[0].Data == "svg" { // hrefs are different in SVGs
-					return
-				}
-			}
-			origlink, exists := s.Attr("href")
-			if exists {
-				formattedurl, err := formatURI(origlink, prox.FinalURL, config.ExternalURL)
-				if err == nil {
-					s.SetAttr("href", formattedurl)
-					s.SetAttr("data-bypass-modified", "true")
-				}
-			}
-		})
-		prox.Document.Find("*[src]").Each(func(i int, s *goquery.Selection) { // Modify all src attributes
-			origlink, exists := s.Attr("src")
-			if exists {
-				formattedurl, err := formatURI(origlink, prox.FinalURL, config.ExternalURL)
-				if err == nil {
-					s.SetAttr("src", formattedurl)
-					s.SetAttr("data-bypass-modified", "true")
-				}
-			}
-		})
-		prox.Document.Find("*[srcset]").Each(func(i int, s *goquery.Selection) { // Modify all srcset attributes
-			origlink, exists := s.Attr("srcset")
-			if exists {
-				srcset := srcset.Parse(origlink)
-				replacedurl := origlink
-				for i := range srcset {
-					formattedurl, err := formatURI(srcset[i].URL, prox.FinalURL, config.ExternalURL)
-					if err == nil {
-						replacedurl = strings.Replace(replacedurl, srcset[i].URL, formattedurl, 1)
-						s.SetAttr("srcset", replacedurl)
-						s.SetAttr("data-bypass-modified", "true")
-					}
-				}
-			}
-		})
-		prox.Document.Find("*[style]").Each(func(i int, s *goquery.Selection) { // Modify all srcset attributes
-			style, exists := s.Attr("style")
-			if exists {
-				replacedStyle := urlRegexp.ReplaceAllStringFunc(style, replFunc)
-				s.SetAttr("style", replacedStyle)
-				s.SetAttr("data-bypass-modified", "true")
-			}
-		})
-		prox.Document.Find("style").Each(func(i int, s *goquery.Selection) {
-			replacedStyle := urlRegexp.ReplaceAllStringFunc(s.Text(), replFunc)
-			s.SetText(replacedStyle)
-		})
-		prox.Document.Find("*[poster]").Each(func(i int, s *goquery.Selection) { // Modify all poster attributes
-			origlink, exists := s.Attr("poster")
-			if exists {
-				formattedurl, err := formatURI(origlink, prox.FinalURL, config.ExternalURL)
-				if err == nil {
-					s.SetAttr("poster", formattedurl)
-					s.SetAttr("data-bypass-modified", "true")
-				}
-			}
-		})
 
-		if config.StripIntegrityAttributes {
-			prox.Document.Find("*[integrity]").Each(func(i int, s *goquery.Selection) { // Remove integrity attributes, because we modify CSS
-				s.RemoveAttr("integrity")
-			})
+		rewriter := &htmlRewriter{BaseURL: prox.FinalURL, Link: link}
+		if config.ServiceWorker {
+			rewriter.Inject = serviceWorkerSnippet(link.ExternalURL)
+		}
+		resWriter.WriteHeader(httpCliResp.StatusCode)
+		start, readBefore := time.Now(), upstreamBody.Elapsed
+		err = rewriter.Rewrite(resWriter, resReader) // The page is written out as it's rewritten, so we can't serve an error page past this point
+		rewriteDuration.WithLabelValues("html").Observe(time.Since(start).Seconds())
+		span := trace.SpanFromContext(rewriteCtx) // The page is read, decoded and rewritten all at once, so the time spent on each is added up instead of having its own span
+		upstreamRead := upstreamBody.Elapsed - readBefore
+		span.SetAttributes(attribute.Float64("bypass.upstream_read_seconds", upstreamRead.Seconds()))
+		if decoded != nil {
+			span.SetAttributes(attribute.String("bypass.charset", prox.ConType.Parameters["charset"]), attribute.Float64("bypass.charset_decode_seconds", (decoded.Elapsed-upstreamRead).Seconds()))
 		}
-
-		parsedhtml, err := goquery.OuterHtml(prox.Document.Selection)
 		if err != nil {
-			return &reqError{err, "Couldn't convert parsed document back to HTML.", 500}
+			stages.Fail(err)
+			requestLogger(reqHTTP).Warn("couldn't rewrite the page", "error", err, "url", redactURL(prox.FinalURL))
 		}
-		prox.FormattedBody = parsedhtml
-
-		_, err = fmt.Fprint(resWriter, prox.FormattedBody)
+	} else if transform := transformerFor(prox.ConType, prox.FinalURL); transform != nil {
+		stages.Next(reqHTTP.Context(), "read body")
+		body, err := ioutil.ReadAll(prox.Body) // Transformers need the whole body
 		if err != nil {
-			return &reqError{err, "Couldn't write content to response.", 500}
+			stages.Fail(err)
+			return &reqError{err, "Couldn't read returned body.", 400}
+		}
+		stages.Next(reqHTTP.Context(), "transform")
+		transformed, err := transform(string(body), prox.FinalURL, link)
+		if err != nil { // Looks like we can't transform this, let's just spit out the raw response
+			stages.Fail(err)
+			requestLogger(reqHTTP).Warn("couldn't transform the response", "error", err, "url", redactURL(prox.FinalURL))
+			transformed = string(body)
 		}
-	} else if prox.ConType.Type == "text" && prox.ConType.Subtype == "css" && config.ModifyCSS {
-		replacedBody := urlRegexp.ReplaceAllStringFunc(string(prox.Body), replFunc)
-		_, err = fmt.Fprint(resWriter, replacedBody)
+		stages.Next(reqHTTP.Context(), "write response")
+		resWriter.WriteHeader(httpCliResp.StatusCode)
+		_, err = fmt.Fprint(resWriter, transformed)
 		if err != nil {
 			return &reqError{err, "Couldn't write content to response.", 500}
 		}
 	} else { // It's not html apparently, just give the raw response
-		_, err = fmt.Fprint(resWriter, string(prox.Body))
+		stages.Next(reqHTTP.Context(), "stream response")
+		resWriter.WriteHeader(httpCliResp.StatusCode)
+		_, err = io.Copy(resWriter, prox.Body)
 		if err != nil {
 			return &reqError{err, "Couldn't write content to response.", 500}
 		}
@@ -272,3 +298,155 @@ func proxyHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqErro
 
 	return nil
 }
+
+func encodeHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqError { // Handle requests to /encode, which format URLs for Bypass' own scripts, since they can't make tokens themselves
+	if reqHTTP.Method != "POST" {
+		return &reqError{nil, "URLs can only be encoded with a POST request.", 405}
+	}
+	externalURL, err := requestExternalURL(reqHTTP)
+	if err != nil {
+		return &reqError{err, "Bypass isn't served from this host.", 400}
+	}
+	if !isSameOrigin(reqHTTP, externalURL) { // Other sites shouldn't be able to make links through the proxy
+		return &reqError{nil, "URLs can only be encoded by Bypass itself.", 403}
+	}
+
+	link := &linkBase{ExternalURL: externalURL, Session: tokenSession(reqHTTP)}
+	if config.TokenBindSession && link.Session == "" {
+		link.Session, err = startTokenSession(resWriter, link.ExternalURL)
+		if err != nil {
+			return &reqError{err, "Couldn't start a new session.", 500}
+		}
+	}
+
+	target := reqHTTP.PostFormValue("url")
+	if target == "" {
+		return &reqError{nil, "No URL was provided.", 400}
+	}
+
+	var formatted string
+	if base := reqHTTP.PostFormValue("base"); base != "" { // The URL was requested by a proxied page, so resolve it against the page's real URL
+		parsedbase, err := url.Parse(base)
+		if err != nil {
+			return &reqError{err, "Couldn't parse provided base URL.", 400}
+		}
+		baseURL, err := codec.Decode(parsedbase, link.Session)
+		if err != nil {
+			return &reqError{err, "Couldn't decode provided base URL.", 400}
+		}
+		parsedtarget, err := url.Parse(target)
+		if err == nil && parsedtarget.Host == parsedbase.Host { // A relative URL that the browser resolved against the proxy instead of the proxied page
+			target = (&url.URL{Path: parsedtarget.Path, RawQuery: parsedtarget.RawQuery, Fragment: parsedtarget.Fragment}).String()
+		}
+		formatted, err = formatURI(target, baseURL, link)
+		if err != nil {
+			return &reqError{err, "Couldn't format provided URL.", 400}
+		}
+	} else { // The URL was typed in by the user, so it's left for proxyHandler to fix up
+		formatted, err = proxiedURL(target, link)
+		if err != nil {
+			return &reqError{err, "Couldn't encode provided URL.", 500}
+		}
+	}
+
+	resWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	resWriter.Header().Set("Cache-Control", "no-store") // Tokens are different every time, and may be bound to a session
+	_, err = fmt.Fprint(resWriter, formatted)
+	if err != nil {
+		return &reqError{err, "Couldn't write content to response.", 500}
+	}
+	return nil
+}
+
+func isSameOrigin(reqHTTP *http.Request, proxyURL string) bool { // Check that a request was made by a page on the proxy's own origin
+	if site := reqHTTP.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin := reqHTTP.Header.Get("Origin")
+	if origin == "" { // Older browsers don't send either header for same-origin requests
+		return true
+	}
+	externalURL, err := url.Parse(proxyURL) // Not the request's Host, which reverse proxies may have rewritten
+	if err != nil {
+		return false
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil || originURL.Scheme != externalURL.Scheme {
+		return false
+	}
+	host, proxyHost := strings.ToLower(originURL.Host), strings.ToLower(externalURL.Host)
+	if host == proxyHost {
+		return true
+	}
+	label := strings.TrimSuffix(host, "."+proxyHost)
+	return config.IsolateOrigins && label != host && label != "" && !strings.Contains(label, ".") // Origin subdomains can encode URLs too
+}
+
+type transformer func(body string, baseURL string, link *linkBase) (string, error) // Transformers modify the URLs in a non-HTML response body
+
+func transformerFor(conType *contentType, baseURL string) transformer { // Pick the transformer for a content type, returning nil if it shouldn't be modified
+	mimeType := conType.Type + "/" + conType.Subtype
+	urlPath := "" // Path of the URL, without the query string that would hide its extension
+	if parsedURL, err := url.Parse(baseURL); err == nil {
+		urlPath = parsedURL.Path
+	}
+	switch mimeType {
+	case "text/css":
+		if config.ModifyCSS {
+			return timedTransformer("css", func(body string, baseURL string, link *linkBase) (string, error) {
+				return modifyCSS(body, baseURL, link), nil
+			})
+		}
+	case "application/javascript", "text/javascript", "application/x-javascript", "application/ecmascript", "text/ecmascript":
+		if config.ModifyJS {
+			return timedTransformer("js", modifyJS)
+		}
+	case "application/importmap+json":
+		if config.ModifyJS {
+			return timedTransformer("importmap", modifyImportMap)
+		}
+	case "application/rss+xml", "application/atom+xml", "application/xml", "text/xml":
+		if config.ModifyXML {
+			return timedTransformer("xml", modifyXML)
+		}
+	case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl":
+		if config.ModifyMedia {
+			return timedTransformer("hls", modifyHLS)
+		}
+	case "application/manifest+json":
+		if config.ModifyManifests {
+			return timedTransformer("manifest", modifyManifest)
+		}
+	case "application/dash+xml":
+		if config.ModifyMedia {
+			return timedTransformer("dash", modifyDASH)
+		}
+	case "application/octet-stream", "text/plain", "binary/octet-stream": // Some servers don't know the types of streaming manifests, so go by the extension
+		if config.ModifyMedia && path.Ext(urlPath) == ".m3u8" {
+			return timedTransformer("hls", modifyHLS)
+		} else if config.ModifyMedia && path.Ext(urlPath) == ".mpd" {
+			return timedTransformer("dash", modifyDASH)
+		}
+	}
+	if mimeType == "application/json" && config.ModifyManifests && (strings.HasSuffix(urlPath, "manifest.json") || path.Ext(urlPath) == ".webmanifest") { // Manifests are usually served as plain JSON
+		return timedTransformer("manifest", modifyManifest)
+	}
+	if mimeType == "application/json" || mimeType == "text/json" || strings.HasSuffix(mimeType, "+json") || strings.HasPrefix(mimeType, "application/json+") { // Includes oEmbed's application/json+oembed
+		if config.ModifyJSON && jsonDomainAllowed(baseURL) {
+			return timedTransformer("json", modifyJSON)
+		}
+	}
+	return nil
+}
+
+func modifyCSS(css string, baseURL string, link *linkBase) string { // Modify all url() references in a CSS stylesheet or style attribute
+	return cssURLRegexp.ReplaceAllStringFunc(css, func(origURI string) string {
+		submatch := cssURLRegexp.FindStringSubmatch(origURI)[1] // This is how we get the regex's capture group (we get google.com out of url("google.com)
+		fURI, err := formatURI(submatch, baseURL, link)         // Fully format the URI
+		if err != nil {
+			slog.Debug("couldn't format a URL in CSS", "error", err)
+			return origURI // If we can't format it just return the original
+		}
+		return "url('" + fURI + "')" // We also need to add the url() part back in
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsSameOrigin(t *testing.T) {
+	defer func(isolate bool) { config.IsolateOrigins = isolate }(config.IsolateOrigins)
+	tests := []struct {
+		host    string // Host header, which a reverse proxy may have rewritten
+		origin  string
+		site    string // Sec-Fetch-Site header
+		isolate bool
+		want    bool
+	}{
+		{"bypass.example", "https://bypass.example", "", false, true},
+		{"127.0.0.1:8000", "https://bypass.example", "", false, true},
+		{"127.0.0.1:8000", "https://BYPASS.example", "", false, true},
+		{"127.0.0.1:8000", "http://bypass.example", "", false, false},
+		{"127.0.0.1:8000", "https://evil.example", "", false, false},
+		{"127.0.0.1:8000", "https://bypass.example.evil.example", "", false, false},
+		{"127.0.0.1:8000", "https://0123456789abcdef.bypass.example", "", true, true},
+		{"127.0.0.1:8000", "https://0123456789abcdef.bypass.example", "", false, false},
+		{"127.0.0.1:8000", "https://a.b.bypass.example", "", true, false},
+		{"127.0.0.1:8000", "null", "", false, false},
+		{"127.0.0.1:8000", "", "", false, true},
+		{"127.0.0.1:8000", "https://evil.example", "same-origin", false, true},
+		{"127.0.0.1:8000", "https://bypass.example", "cross-site", false, false},
+	}
+	for _, test := range tests {
+		config.IsolateOrigins = test.isolate
+		reqHTTP := httptest.NewRequest("POST", "http://"+test.host+"/encode", nil)
+		if test.origin != "" {
+			reqHTTP.Header.Set("Origin", test.origin)
+		}
+		if test.site != "" {
+			reqHTTP.Header.Set("Sec-Fetch-Site", test.site)
+		}
+		if got := isSameOrigin(reqHTTP, "https://bypass.example/"); got != test.want {
+			t.Errorf("Host %s, Origin %q, Sec-Fetch-Site %q: got %v, want %v", test.host, test.origin, test.site, got, test.want)
+		}
+	}
+}
+
+func TestTransformerForStreamingManifests(t *testing.T) {
+	defer func(media bool) { config.ModifyMedia = media }(config.ModifyMedia)
+	config.ModifyMedia = true
+	conType := &contentType{Type: "application", Subtype: "octet-stream", Parameters: map[string]string{}}
+
+	tests := []struct {
+		url string
+		hls bool // Whether it should be rewritten as an HLS playlist
+		any bool // Whether it should be rewritten at all
+	}{
+		{"https://cdn.example.com/live/playlist.m3u8", true, true},
+		{"https://cdn.example.com/live/playlist.m3u8?token=abc&exp=123", true, true},
+		{"https://cdn.example.com/live/playlist.m3u8#t=10", true, true},
+		{"https://cdn.example.com/vod/manifest.mpd?token=abc", false, true},
+		{"https://cdn.example.com/download?file=playlist.m3u8", false, false},
+		{"https://cdn.example.com/live/playlist.m3u8.bak", false, false},
+	}
+	for _, test := range tests {
+		transform := transformerFor(conType, test.url)
+		if (transform != nil) != test.any {
+			t.Errorf("%s: got a transformer %v, want %v", test.url, transform != nil, test.any)
+			continue
+		}
+		if !test.hls {
+			continue
+		}
+		body, err := transform("#EXTM3U\n#EXTINF:10,\nsegment0.ts\n", test.url, testLink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body, testProxied("https://cdn.example.com/live/segment0.ts")) {
+			t.Errorf("%s: segment wasn't rewritten:\n%s", test.url, body)
+		}
+	}
+}
+
+func TestTransformerForManifests(t *testing.T) {
+	defer func(manifests bool, jsonOn bool) { config.ModifyManifests, config.ModifyJSON = manifests, jsonOn }(config.ModifyManifests, config.ModifyJSON)
+	config.ModifyManifests, config.ModifyJSON = true, false // So that only manifests get a transformer
+	conType := &contentType{Type: "application", Subtype: "json", Parameters: map[string]string{}}
+
+	for url, want := range map[string]bool{
+		"https://example.com/manifest.json":           true,
+		"https://example.com/manifest.json?v=2":       true,
+		"https://example.com/app.webmanifest?v=2":     true,
+		"https://example.com/api?file=manifest.json":  false,
+		"https://example.com/data.json#manifest.json": false,
+	} {
+		if got := transformerFor(conType, url) != nil; got != want {
+			t.Errorf("%s: got a transformer %v, want %v", url, got, want)
+		}
+	}
+}
@@ -1,33 +1,121 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
 type configuration struct { // The configuration type holds configuration data
-	Host                     string // Host string for the webserver to listen on
-	Port                     string // Port string for the webserver to listen on
-	PublicDir                string // Path string to the directory to serve static files from
-	CacheStatic              bool   // Boolean to enable or disable file caching
-	StripCORS                bool   // Boolean to strip CORS headers
-	StripIntegrityAttributes bool   // Boolean to strip 'integrity' attributes in HTML
-	StripFrameOptions        bool   // Boolean to strip X-Frame-Options headers
-	ModifyHTML               bool   // Boolean to modify HTML
-	ModifyCSS                bool   // Boolean to modify CSS
-	ExternalURL              string // External URL string for formatting proxied HTML
-	EnableTLS                bool   // Boolean to serve with TLS
-	Verbose                  bool   // Boolean to disable logs of 404 errors
-	TLSCertPath              string // Path to SSL Certificate
-	TLSKeyPath               string // Path to private key for certificate
+	ConfigFile                string         // Path to a YAML file of settings, which flags and environment variables override
+	Host                      string         // Host string for the webserver to listen on
+	Port                      string         // Port string for the webserver to listen on
+	Listen                    stringList     // Addresses to listen on, instead of Host and Port
+	ReadTimeout               time.Duration  // How long reading a whole request (including its body) can take
+	ReadHeaderTimeout         time.Duration  // How long reading a request's headers can take
+	WriteTimeout              time.Duration  // How long writing a response can take, or zero for no limit
+	ServerIdleTimeout         time.Duration  // How long idle keep-alive connections from clients are kept open for
+	MaxHeaderBytes            int            // Maximum size of a request's headers
+	DrainTimeout              time.Duration  // How long requests in progress get to finish when Bypass is shutting down
+	PublicDir                 string         // Path string to the directory to serve static files from
+	CacheStatic               bool           // Boolean to enable or disable file caching
+	StripCORS                 bool           // Boolean to strip CORS headers
+	StripIntegrityAttributes  bool           // Boolean to strip 'integrity' attributes in HTML
+	StripFrameOptions         bool           // Boolean to strip X-Frame-Options headers
+	ModifyHTML                bool           // Boolean to modify HTML
+	ModifyCSS                 bool           // Boolean to modify CSS
+	ModifyJS                  bool           // Boolean to modify JavaScript module imports, workers and import maps
+	ModifyJSON                bool           // Boolean to modify URLs in JSON
+	JSONDomains               stringList     // Domains to modify JSON from, or every domain if empty
+	ModifyXML                 bool           // Boolean to modify RSS, Atom, sitemaps and other XML
+	ModifyMedia               bool           // Boolean to modify HLS playlists and DASH manifests
+	ModifyManifests           bool           // Boolean to modify web app manifests
+	SchemePolicies            schemePolicies // What to do with URLs of each scheme (pass, proxy, neutralize or block)
+	MaxRewriteDepth           int            // Maximum depth of nested documents (srcdoc, template and noscript) to modify
+	ExternalURL               string         // External URL string for formatting proxied HTML
+	BasePath                  string         // Path prefix that Bypass is served under
+	ExternalURLFromRequest    bool           // Boolean to build the external URL from each request's Host and scheme
+	ExternalHosts             stringList     // Hosts that the external URL can be built with, when it comes from the request
+	TrustedProxies            stringList     // IPs and CIDR ranges of reverse proxies whose X-Forwarded-Proto and X-Forwarded-Host headers are trusted
+	IsolateOrigins            bool           // Boolean to serve every upstream origin from its own subdomain of ExternalURL
+	URLFormat                 string         // Name of the codec used to put proxied URLs into the proxy's URLs
+	ServiceWorker             bool           // Boolean to install a service worker that sends requests made at runtime through the proxy
+	BlockOriginServiceWorkers bool           // Boolean to stop proxied pages from registering their own service workers
+	TokenKeyFile              string         // Path to a file of keys to encrypt URLs with, or empty to only base64 encode them
+	TokenTTL                  time.Duration  // How long encrypted URLs stay valid for, or forever if zero
+	TokenBindSession          bool           // Boolean to make encrypted URLs only work for the client that they were made for
+	ProxyLimit                limitRule      // Limits for each client's requests to the proxy
+	UILimit                   limitRule      // Limits for each client's requests to the static UI
+	LoginLimit                limitRule      // Limits for each client's login attempts, which are slow to check
+	DialTimeout               time.Duration  // How long connecting to an upstream host can take
+	TLSTimeout                time.Duration  // How long a TLS handshake with an upstream host can take
+	HeaderTimeout             time.Duration  // How long an upstream host can take to start responding, once it's been sent a request
+	UpstreamTimeout           time.Duration  // How long a whole upstream request (including its body) can take, or zero for no limit
+	IdleConns                 int            // Maximum idle connections to upstream hosts kept for reuse
+	IdleConnsPerHost          int            // Maximum idle connections to each upstream host kept for reuse
+	IdleTimeout               time.Duration  // How long idle connections to upstream hosts are kept for
+	HostConcurrency           int            // Maximum requests in progress to each upstream host, or zero for no limit
+	BreakerFailures           int            // Timeouts and 5xx responses in a row that pause requests to an upstream host, or zero to never pause them
+	BreakerCooldown           time.Duration  // How long requests to a failing upstream host are paused for
+	Admin                     bool           // Boolean to serve the admin view at /admin/
+	Metrics                   bool           // Boolean to serve Prometheus metrics at /metrics
+	AdminListen               stringList     // Addresses to serve the admin view and metrics on, instead of with everything else
+	TraceEndpoint             string         // URL of the OTLP/HTTP endpoint to send traces to, or empty to not trace
+	TraceSampleRatio          float64        // Fraction of requests to trace, when the client's trace doesn't decide
+	TraceExtract              string         // Whose traceparent headers to continue traces from (none, trusted or all)
+	TraceUpstream             bool           // Boolean to send traceparent headers to upstream hosts
+	AuthHtpasswd              string         // Path to an htpasswd file of users that can log in with HTTP basic auth (or the login page)
+	AuthTokens                string         // Path to a file of bearer tokens that can be used to authenticate
+	AuthLogin                 bool           // Boolean to send browsers to a login page, which sets a signed session cookie
+	AuthCookieKey             string         // Path to the key that session cookies are signed with
+	AuthTTL                   time.Duration  // How long login sessions last for
+	AuthAreas                 stringList     // Parts of Bypass that need authentication (ui, proxy and admin)
+	OIDCIssuer                string         // URL of the OpenID Connect identity provider to log in with
+	OIDCClientID              string         // Client ID that Bypass is registered with at the identity provider
+	OIDCClientSecret          string         // Path to the client secret that Bypass is registered with
+	OIDCScopes                stringList     // Scopes to ask for, on top of openid
+	OIDCAllow                 stringList     // claim=value rules that users need to match one of to be let in
+	OIDCUserClaim             string         // Claim that holds the user's name
+	EnableTLS                 bool           // Boolean to serve with TLS
+	Verbose                   bool           // Boolean to disable logs of 404 errors
+	LogFormat                 string         // Format of the log (text or json)
+	LogLevel                  string         // Least severe level that's logged (debug, info, warn or error)
+	AccessLog                 string         // Path to write the access log to, - for stdout or empty for no access log
+	AccessLogFormat           string         // Format of the access log (clf or json)
+	LogRedact                 string         // How much of proxied URLs to hide in logs (none, query, host or all)
+	TLSCertPath               string         // Path to SSL Certificate
+	TLSKeyPath                string         // Path to private key for certificate
 }
 
 type reqHandler func(http.ResponseWriter, *http.Request) *reqError
 
+type stringList []string // The stringList type is a flag value that holds a comma separated list
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
+}
+
 var config configuration // configuration for the entire program
 var notFoundPage []byte  // Cached 404 page
 
@@ -36,54 +124,211 @@ func init() {
 	flag.BoolVar(&config.CacheStatic, "cachestatic", true, "cache specific heavily used static files")
 	flag.BoolVar(&config.StripCORS, "cors", true, "strip Cross Origin Resource Policy headers")
 	flag.BoolVar(&config.EnableTLS, "tls", false, "enable serving with TLS (https)")
-	flag.BoolVar(&config.Verbose, "verbose", false, "enable printing 404 errors to STDOUT")
+	flag.BoolVar(&config.Verbose, "verbose", false, "enable logging 404 errors")
+	flag.StringVar(&config.LogFormat, "log-format", "text", "format of the log on STDERR (text or json)")
+	flag.StringVar(&config.LogLevel, "log-level", "info", "least severe level of messages to log (debug, info, warn or error)")
+	flag.StringVar(&config.AccessLog, "access-log", "", "path to write an access log to, or - for STDOUT (no access log if empty)")
+	flag.StringVar(&config.AccessLogFormat, "access-log-format", "clf", "format of the access log (clf for Common Log Format, or json)")
+	flag.StringVar(&config.LogRedact, "log-redact", "query", "how much of proxied URLs to hide in logs: none, query (also hides fragments and credentials), host (only keeps the scheme and host) or all")
 	flag.BoolVar(&config.StripFrameOptions, "frameoptions", true, "strip Frame Options headers to allow framing (if disabled this will break pub/index.html)")
 	flag.BoolVar(&config.StripIntegrityAttributes, "integrity", true, "strip 'integrity' attributes in HTML")
 	flag.BoolVar(&config.ModifyCSS, "css", true, "modify CSS to pass URLs through the webproxy")
+	flag.BoolVar(&config.ModifyJS, "js", true, "modify JavaScript imports, workers and import maps to pass URLs through the webproxy")
+	flag.BoolVar(&config.ModifyJSON, "json", false, "modify URLs in JSON responses to pass through the webproxy")
+	flag.Var(&config.JSONDomains, "json-domains", "comma separated list of domains to modify JSON responses from (all domains if empty)")
+	flag.BoolVar(&config.ModifyXML, "xml", true, "modify RSS, Atom, sitemaps and other XML to pass URLs through the webproxy")
+	flag.BoolVar(&config.ModifyMedia, "media", true, "modify HLS playlists and DASH manifests to pass segment URLs through the webproxy")
+	flag.BoolVar(&config.ModifyManifests, "manifest", true, "modify web app manifests to pass URLs through the webproxy")
 	flag.BoolVar(&config.ModifyHTML, "HTML", true, "modify HTML to pass URLs through the webproxy")
+	config.SchemePolicies = defaultSchemePolicies()
+	flag.Var(&config.SchemePolicies, "schemes", "comma separated scheme=policy pairs (policies are pass, proxy, neutralize or block, where blocked links go to an error page from the proxy, and * is every other scheme) that override the defaults of "+config.SchemePolicies.String())
+	flag.IntVar(&config.MaxRewriteDepth, "rewritedepth", 3, "maximum depth of nested HTML documents (iframe srcdoc, template and noscript) to modify")
+	flag.BoolVar(&config.ServiceWorker, "serviceworker", false, "install a service worker in proxied pages that passes requests made at runtime through the webproxy")
+	flag.BoolVar(&config.BlockOriginServiceWorkers, "block-sw", true, "stop proxied pages from registering their own service workers")
 	flag.StringVar(&config.Host, "host", "localhost", "host to listen on for the webserver")
 	flag.StringVar(&config.Port, "port", "8000", "port to listen on for the webserver")
+	flag.Var(&config.Listen, "listen", "comma separated list of addresses to listen on (eg. :8080,[::1]:8080), instead of host and port")
+	flag.DurationVar(&config.ReadTimeout, "read-timeout", time.Minute, "how long reading a whole request from a client can take")
+	flag.DurationVar(&config.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "how long reading a request's headers from a client can take")
+	flag.DurationVar(&config.WriteTimeout, "write-timeout", 0, "how long writing a response to a client can take (no limit if 0, since large downloads and streams take a while)")
+	flag.DurationVar(&config.ServerIdleTimeout, "idle-timeout", 2*time.Minute, "how long idle keep-alive connections from clients are kept open for")
+	flag.IntVar(&config.MaxHeaderBytes, "max-header-bytes", 1<<20, "maximum size of a request's headers, in bytes")
+	flag.DurationVar(&config.DrainTimeout, "drain-timeout", 30*time.Second, "how long requests in progress get to finish when Bypass gets SIGINT or SIGTERM, before they're cut off")
 	flag.StringVar(&config.PublicDir, "pubdir", "pub", "path to the static files the webserver should serve")
 	flag.StringVar(&config.TLSCertPath, "tls-cert", "", "path to certificate file")
 	flag.StringVar(&config.TLSKeyPath, "tls-key", "", "path to private key for certificate")
+	flag.BoolVar(&config.ExternalURLFromRequest, "exturl-from-request", false, "build the external URL from each request's Host and scheme, instead of always using exturl (only its path is kept)")
+	flag.Var(&config.ExternalHosts, "exthosts", "comma separated list of hosts that Bypass can be reached at, when exturl-from-request is enabled (defaults to exturl's host)")
+	flag.Var(&config.TrustedProxies, "trusted-proxies", "comma separated list of IPs and CIDR ranges of reverse proxies whose X-Forwarded-Proto and X-Forwarded-Host headers are trusted")
+	flag.BoolVar(&config.IsolateOrigins, "isolate", false, "serve every proxied origin from its own subdomain of exturl (which needs a wildcard DNS record) so that sites can't reach each other's storage")
+	flag.StringVar(&config.URLFormat, "urlformat", "query", "how proxied URLs are encoded: \"query\" (/p/?u=<base64>), \"path\" (/p/<base64>) or \"readable\" (/p/https/example.com/path)")
+	flag.StringVar(&config.TokenKeyFile, "token-keys", "", "path to a file of AES keys (one \"<id> <base64 key>\" per line, the first is used for new URLs) to encrypt proxied URLs with")
+	flag.DurationVar(&config.TokenTTL, "token-ttl", 0, "how long encrypted URLs stay valid for, which is rounded up by as much as a quarter so that the same URL keeps the same token for a while (forever if 0)")
+	flag.BoolVar(&config.TokenBindSession, "token-session", false, "make encrypted URLs only work in the browser session that they were made for")
+	flag.Var(&config.ProxyLimit, "limit-proxy", "limits for each client (by user, API token or IP) of the proxy, like rate=10/s,burst=20,concurrent=4 (rates can also be per m or h)")
+	flag.Var(&config.UILimit, "limit-ui", "limits for each client (by user, API token or IP) of the static UI, in the same format as limit-proxy")
+	config.LoginLimit = limitRule{Rate: rate.Limit(10.0 / 60), Burst: 5}
+	flag.Var(&config.LoginLimit, "limit-login", "limits for each client (by IP) of login attempts on the login page, in the same format as limit-proxy")
+	flag.DurationVar(&config.DialTimeout, "upstream-dial-timeout", 10*time.Second, "how long connecting to a proxied host can take")
+	flag.DurationVar(&config.TLSTimeout, "upstream-tls-timeout", 10*time.Second, "how long a TLS handshake with a proxied host can take")
+	flag.DurationVar(&config.HeaderTimeout, "upstream-header-timeout", 30*time.Second, "how long a proxied host can take to start responding")
+	flag.DurationVar(&config.UpstreamTimeout, "upstream-timeout", 0, "how long a whole proxied request, including its body, can take (no limit if 0, since large downloads and streams take a while)")
+	flag.IntVar(&config.IdleConns, "upstream-idle-conns", 100, "maximum idle connections to proxied hosts to keep open for reuse")
+	flag.IntVar(&config.IdleConnsPerHost, "upstream-idle-conns-per-host", 8, "maximum idle connections to each proxied host to keep open for reuse")
+	flag.DurationVar(&config.IdleTimeout, "upstream-idle-timeout", 90*time.Second, "how long idle connections to proxied hosts are kept open for")
+	flag.IntVar(&config.HostConcurrency, "host-concurrency", 8, "maximum requests in progress to each proxied host, after which requests wait their turn (no limit if 0)")
+	flag.IntVar(&config.BreakerFailures, "breaker-failures", 5, "timeouts and 5xx responses in a row from a proxied host that make Bypass stop sending it requests for a while (never if 0)")
+	flag.DurationVar(&config.BreakerCooldown, "breaker-cooldown", 30*time.Second, "how long Bypass stops sending requests to a failing host for, before trying it again")
+	flag.BoolVar(&config.Admin, "admin", false, "serve an admin view of proxied hosts and rate limits at /admin/ (protect it with auth-protect or admin-listen, since it shows which sites are being visited)")
+	flag.BoolVar(&config.Metrics, "metrics", false, "serve Prometheus metrics at /metrics")
+	flag.Var(&config.AdminListen, "admin-listen", "comma separated list of addresses to serve the admin view and metrics on (eg. localhost:9090), instead of with everything else")
+	flag.StringVar(&config.TraceEndpoint, "trace-endpoint", "", "URL of an OTLP/HTTP endpoint to send OpenTelemetry traces to (eg. http://localhost:4318/v1/traces), or empty to not trace")
+	flag.Float64Var(&config.TraceSampleRatio, "trace-sample", 1, "fraction of requests to trace (between 0 and 1), unless the trace they're part of was already sampled")
+	flag.StringVar(&config.TraceExtract, "trace-extract", "trusted", "whose traceparent headers to continue traces from: none, trusted (only trusted-proxies) or all")
+	flag.BoolVar(&config.TraceUpstream, "trace-upstream", false, "send traceparent headers to proxied hosts, which tells them that the request was traced (and its trace ID)")
+	flag.StringVar(&config.AuthHtpasswd, "htpasswd", "", "path to an htpasswd file of users (with bcrypt hashes) that can log in with HTTP basic auth or the login page")
+	flag.StringVar(&config.AuthTokens, "auth-tokens", "", "path to a file of bearer tokens that can be used to authenticate, one per line (optionally followed by a user name)")
+	flag.BoolVar(&config.AuthLogin, "auth-login", false, "send browsers to a login page that sets a signed session cookie, instead of asking for basic auth")
+	flag.StringVar(&config.AuthCookieKey, "auth-cookie-key", "", "path to a secret key that session cookies are signed with (a new one is made every time Bypass starts if empty)")
+	flag.DurationVar(&config.AuthTTL, "auth-ttl", 24*time.Hour, "how long login sessions last for")
+	config.AuthAreas = stringList{"ui", "proxy", "admin"}
+	flag.Var(&config.AuthAreas, "auth-protect", "comma separated list of the parts of Bypass that need authentication, when it's configured (ui, proxy, admin)")
+	flag.StringVar(&config.OIDCIssuer, "oidc-issuer", "", "URL of an OpenID Connect identity provider to log in with (eg. https://accounts.example.com)")
+	flag.StringVar(&config.OIDCClientID, "oidc-client-id", "", "client ID that Bypass is registered with at the identity provider")
+	flag.StringVar(&config.OIDCClientSecret, "oidc-client-secret", "", "path to a file holding the client secret that Bypass is registered with (empty for public clients)")
+	config.OIDCScopes = stringList{"profile", "email"}
+	flag.Var(&config.OIDCScopes, "oidc-scopes", "comma separated list of scopes to ask the identity provider for, on top of openid")
+	flag.Var(&config.OIDCAllow, "oidc-allow", "comma separated list of claim=value rules (eg. groups=bypass-users), one of which users need to match to be let in (everyone if empty)")
+	flag.StringVar(&config.OIDCUserClaim, "oidc-user-claim", "email", "ID token claim that holds the user's name (the subject is used if it's missing)")
 	flag.StringVar(&config.ExternalURL, "exturl", "", "external URL for formatting proxied HTML files to link back to the webproxy")
-	flag.Parse() // Parse the rest of the flags
+	flag.StringVar(&config.BasePath, "basepath", "", "path prefix to serve everything under (eg. /tools/bypass), if requests aren't stripped of it before they reach Bypass")
+	flag.StringVar(&config.ConfigFile, "config", "", "path to a YAML file of settings, named like these flags (environment variables named like BYPASS_AUTH_TTL override it, and flags override both)")
+	defineFlagAliases()
 }
 
 func main() { // Main functions
+	flag.Parse() // Parsed here rather than in init, so that go test can parse its own flags
+	if args := flag.Args(); len(args) > 0 {
+		if args[0] != "config" {
+			fmt.Fprintln(os.Stderr, "unknown command "+args[0]+", the only command is config validate")
+			os.Exit(2)
+		}
+		os.Exit(configCommand(args[1:]))
+	}
+	setupConfiguration()
+
+	err = setupLogging()
+	if err != nil {
+		panic(err)
+	}
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		panic(err)
+	}
+
 	if config.ExternalURL == "" {
-		config.ExternalURL = "http://" + config.Host + ":" + config.Port // If nothing is specified, use the default host and port
+		config.ExternalURL = "http://" + config.Host + ":" + config.Port + config.BasePath // If nothing is specified, use the default host and port
 	}
 
-	if config.CacheStatic == true { // Cache certain static files if they exist and if config.CacheStatic is set to true
-		notFoundPage, err = ioutil.ReadFile(config.PublicDir + "/404.html")
+	if len(config.ExternalHosts) == 0 {
+		externalURL, err := url.Parse(config.ExternalURL)
 		if err != nil {
 			panic(err)
 		}
+		config.ExternalHosts = stringList{externalURL.Host}
 	}
-	// Create a HTTP Server, and handle requests and errors
-	http.Handle("/", http.FileServer(http.Dir(config.PublicDir)))
-	http.Handle("/p/", reqHandler(proxyHandler))
-	bind := fmt.Sprintf("%s:%s", config.Host, config.Port)
-	fmt.Printf("Bypass listening on %s...\n", bind)
-	if !config.EnableTLS {
-		err = http.ListenAndServe(bind, nil)
+	trustedProxies, err = parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		panic(err)
+	}
+
+	codec = urlCodecs[config.URLFormat] // setupConfiguration has checked that it exists, and that it can be used with token-keys
+	if config.TokenKeyFile != "" {
+		tokenKeys, err = loadTokenKeys(config.TokenKeyFile)
 		if err != nil {
 			panic(err)
 		}
-	} else if config.EnableTLS {
-		if config.TLSCertPath == "" {
-			panic(errors.New("tls-cert flag must not be empty"))
-		}
-		if config.TLSKeyPath == "" {
-			panic(errors.New("tls-key flag must not be empty"))
-		}
-		fmt.Println("Serving with TLS...")
-		err = http.ListenAndServeTLS(bind, config.TLSCertPath, config.TLSKeyPath, nil)
+	}
+
+	upstreamClient = newUpstreamClient()
+
+	err = setupAuth()
+	if err != nil {
+		panic(err)
+	}
+
+	if config.CacheStatic == true { // Cache certain static files if they exist and if config.CacheStatic is set to true
+		notFoundPage, err = ioutil.ReadFile(config.PublicDir + "/404.html")
 		if err != nil {
 			panic(err)
 		}
+		if config.ServiceWorker {
+			serviceWorkerCache, err = ioutil.ReadFile(config.PublicDir + "/" + serviceWorkerScript)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+	// Create a HTTP Server, and handle requests and errors
+	uiLimiter, proxyLimiter := newRouteLimiter("ui", config.UILimit), newRouteLimiter("proxy", config.ProxyLimit) // Limits go inside authentication, so that they know who the user is
+	http.Handle("/", requireAuth("ui", uiLimiter.Wrap(http.FileServer(http.Dir(config.PublicDir)))))
+	http.Handle("/p/", requireAuth("proxy", proxyLimiter.Wrap(reqHandler(proxyHandler))))
+	http.Handle("/encode", requireAuth("proxy", proxyLimiter.Wrap(reqHandler(encodeHandler))))
+	if config.ServiceWorker {
+		http.Handle("/"+serviceWorkerScript, requireAuth("proxy", reqHandler(serviceWorkerHandler)))
+	}
+	if config.AuthLogin {
+		http.Handle("/login.html", http.FileServer(http.Dir(config.PublicDir))) // Everyone has to be able to see the login page
+		loginLimiter := newRouteLimiter("login", config.LoginLimit)             // Checking passwords is slow on purpose, so guessing them has to be too
+		http.Handle("/login", loginLimiter.Wrap(reqHandler(loginHandler)))
+	}
+	if oidcAuth != nil {
+		http.Handle("/oidc/login", reqHandler(oidcLoginHandler))
+		http.Handle("/oidc/callback", reqHandler(oidcCallbackHandler))
+	}
+	if loginSessions != nil {
+		http.Handle("/logout", reqHandler(logoutHandler))
+	}
+	adminMux := http.DefaultServeMux
+	if len(config.AdminListen) > 0 { // Admin pages get their own listener, which can be kept off the public network
+		adminMux = http.NewServeMux()
+	}
+	if config.Admin {
+		adminMux.Handle("/admin/", requireAuth("admin", reqHandler(adminHandler)))
 	}
+	if config.Metrics {
+		adminMux.Handle("/metrics", requireAuth("admin", metricsHandler()))
+	}
+	var handler http.Handler = withRoute(http.DefaultServeMux)
+	if config.IsolateOrigins {
+		handler = isolateOrigins(handler)
+	}
+	if strings.Trim(config.BasePath, "/") != "" {
+		handler = mountUnder(config.BasePath, handler)
+	}
+	handler = withRequestLogging(withTracing(handler)) // Outermost, so that every request is logged and traced
+	addrs := []string(config.Listen)
+	if len(addrs) == 0 {
+		addrs = []string{fmt.Sprintf("%s:%s", config.Host, config.Port)}
+	}
+	if config.EnableTLS {
+		slog.Info("serving with TLS")
+	}
+	groups := []listenGroup{{newServer(handler), addrs, "main"}}
+	if len(config.AdminListen) > 0 {
+		groups = append(groups, listenGroup{newServer(withRequestLogging(withRoute(adminMux))), config.AdminListen, "admin"})
+	}
+	err = serve(groups...)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if traceErr := shutdownTracing(ctx); traceErr != nil { // Send the last spans before we exit
+		slog.Warn("couldn't send the last traces", "error", traceErr)
+	}
+	if err != nil {
+		slog.Error("couldn't serve", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Bypass has shut down")
 }
 
 func (fn reqHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) { // Allows us to pass errors back through our http handling functions
@@ -91,11 +336,13 @@ func (fn reqHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) { // Allo
 		if e.Code == 404 { // Serve a pretty (potentially cached) file for 404 errors, if it exists
 			w.WriteHeader(404)
 			if config.Verbose && e.Error != nil {
-				fmt.Println(e.Error.Error(), "\n", e.Message) // Print the error message
+				requestLogger(r).Info(redactMessage(r, e.Message), "error", redactError(e.Error), "status", e.Code) // Log the error message
 			}
 			if notFoundPage != nil && config.CacheStatic { // Serve the cached file if one exists
-				io.WriteString(w, string(notFoundPage))
+				staticCacheTotal.WithLabelValues("hit").Inc()
+				io.WriteString(w, withBaseElement(string(notFoundPage), r))
 			} else { // Read a non-cached file from disk and serve it because there isn't a cached one
+				staticCacheTotal.WithLabelValues("miss").Inc()
 				file, err := ioutil.ReadFile(config.PublicDir + "/404.html")
 				if err != nil {
 					if e.Error == nil { // Is there an included Error type
@@ -105,17 +352,29 @@ func (fn reqHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) { // Allo
 					}
 					return
 				}
-				io.WriteString(w, string(file))
+				io.WriteString(w, withBaseElement(string(file), r))
 			}
 		} else { // If it's not a 404 error just serve a generic message
+			level := slog.LevelWarn
+			if e.Code >= 500 {
+				level = slog.LevelError
+			}
 			if e.Error == nil {
-				fmt.Println(e.Message)
+				requestLogger(r).Log(r.Context(), level, redactMessage(r, e.Message), "status", e.Code)
 				http.Error(w, e.Message, e.Code) // Serve a generic error message if the file isn't cached and doesn't exist
 			} else {
-				fmt.Println(e.Error.Error(), "\n", e.Message)         // Print the error message
-				http.Error(w, e.Message+"\n"+e.Error.Error(), e.Code) // Serve a generic error message if the file isn't cached and doesn't exist
+				requestLogger(r).Log(r.Context(), level, redactMessage(r, e.Message), "error", redactError(e.Error), "status", e.Code) // Log the error message
+				http.Error(w, e.Message+"\n"+e.Error.Error(), e.Code)                                                                  // Serve a generic error message if the file isn't cached and doesn't exist
 			}
 		}
 
 	}
 }
+
+func withBaseElement(page string, r *http.Request) string { // Add a base element to a page, so that its relative links work from any path under the proxy
+	externalURL, err := requestExternalURL(r)
+	if err != nil {
+		externalURL = config.ExternalURL
+	}
+	return strings.Replace(page, "<head>", `<head><base href="`+html.EscapeString(externalPath(externalURL))+`">`, 1)
+}
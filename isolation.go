@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func originLabel(target *url.URL) string { // Get the subdomain label that an upstream origin is isolated in
+	sum := sha256.Sum256([]byte(strings.ToLower(target.Scheme + "://" + target.Host)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func isolatedHost(proxyHost string, target *url.URL) string { // Get the host that an upstream origin is served from, under the proxy's host
+	return originLabel(target) + "." + proxyHost
+}
+
+func requestLabel(reqHTTP *http.Request, proxyURL string) (string, bool) { // Get the subdomain label that a request was made to, if it was made to one
+	externalURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return "", false
+	}
+	host := strings.ToLower(reqHTTP.Host)
+	suffix := "." + strings.ToLower(externalURL.Host)
+	if !strings.HasSuffix(host, suffix) {
+		return "", false
+	}
+	label := strings.TrimSuffix(host, suffix)
+	return label, label != "" && !strings.Contains(label, ".")
+}
+
+func isolatedURL(reqHTTP *http.Request, proxyURL string, target *url.URL) string { // Get the URL that a request for target should have been made to
+	externalURL, _ := url.Parse(proxyURL)
+	return externalURL.Scheme + "://" + isolatedHost(externalURL.Host, target) + strings.TrimSuffix(externalURL.Path, "/") + reqHTTP.URL.RequestURI() // The request's path has had the base path stripped from it
+}
+
+func isolateOrigins(handler http.Handler) http.Handler { // Only serve proxied pages (and what they need) on origin subdomains, so that they can't reach the rest of the proxy
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		externalURL, err := requestExternalURL(reqHTTP)
+		if err != nil {
+			http.Error(resWriter, "Bypass isn't served from this host.", 400)
+			return
+		}
+		if _, ok := requestLabel(reqHTTP, externalURL); ok {
+			path := reqHTTP.URL.Path
+			if !strings.HasPrefix(path, "/p/") && path != "/encode" && path != "/"+serviceWorkerScript {
+				http.NotFound(resWriter, reqHTTP)
+				return
+			}
+		}
+		handler.ServeHTTP(resWriter, reqHTTP)
+	})
+}
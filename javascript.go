@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+type jsToken struct { // The jsToken type holds a single lexed JavaScript token
+	Type js.TokenType // The type of the token, as determined by the lexer
+	Data []byte       // The token exactly as it appears in the source
+}
+
+type importMap struct { // The importMap type holds the contents of a <script type="importmap"> element
+	Imports   map[string]string            `json:"imports,omitempty"`   // Module specifiers mapped to URLs
+	Scopes    map[string]map[string]string `json:"scopes,omitempty"`    // URL prefixes mapped to sets of specifier mappings that only apply under them
+	Integrity map[string]string            `json:"integrity,omitempty"` // URLs mapped to integrity metadata
+}
+
+var regExpPrecedingKeywords = map[js.TokenType]bool{ // Keywords after which a slash starts a regular expression instead of a division
+	js.ReturnToken: true, js.TypeofToken: true, js.InstanceofToken: true, js.InToken: true, js.OfToken: true,
+	js.NewToken: true, js.DeleteToken: true, js.VoidToken: true, js.ThrowToken: true, js.CaseToken: true,
+	js.DoToken: true, js.ElseToken: true, js.YieldToken: true, js.AwaitToken: true,
+}
+
+func modifyJS(source string, baseURL string, link *linkBase) (string, error) { // Modify the URLs in static imports and exports, dynamic imports, workers and importScripts calls
+	tokens, err := lexJS(source)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for i, token := range tokens {
+		if token.Type != js.StringToken {
+			sb.Write(token.Data)
+			continue
+		}
+		if isURL, isSpecifier := isJSURL(tokens, i); isURL || isSpecifier {
+			if formatted, ok := formatJSString(token.Data, isSpecifier, baseURL, link); ok {
+				sb.WriteString(formatted)
+				continue
+			}
+		}
+		sb.Write(token.Data)
+	}
+	return sb.String(), nil
+}
+
+func lexJS(source string) ([]jsToken, error) { // Split JavaScript source into tokens, telling apart regular expressions and divisions as we go
+	lexer := js.NewLexer(parse.NewInputString(source))
+	var tokens []jsToken
+	var prev js.TokenType = js.ErrorToken // The last token that wasn't whitespace or a comment, ErrorToken if there isn't one
+	for {
+		tokenType, data := lexer.Next()
+		if tokenType == js.ErrorToken {
+			if lexer.Err() == io.EOF {
+				return tokens, nil
+			}
+			return nil, lexer.Err()
+		}
+		if (tokenType == js.DivToken || tokenType == js.DivEqToken) && startsRegExp(prev) { // The lexer can't tell these apart without knowing the previous token
+			tokenType, data = lexer.RegExp()
+			if tokenType == js.ErrorToken {
+				return nil, lexer.Err()
+			}
+		}
+		tokens = append(tokens, jsToken{tokenType, data})
+		if !isJSSpace(tokenType) {
+			prev = tokenType
+		}
+	}
+}
+
+func startsRegExp(prev js.TokenType) bool { // Checks if a slash following prev is the start of a regular expression
+	switch {
+	case prev == js.ErrorToken:
+		return true
+	case prev == js.CloseParenToken, prev == js.CloseBracketToken:
+		return false
+	case js.IsPunctuator(prev), js.IsOperator(prev):
+		return true
+	}
+	return regExpPrecedingKeywords[prev]
+}
+
+func isJSSpace(tokenType js.TokenType) bool {
+	return tokenType == js.WhitespaceToken || tokenType == js.LineTerminatorToken || tokenType == js.CommentToken || tokenType == js.CommentLineTerminatorToken
+}
+
+func isJSURL(tokens []jsToken, i int) (isURL bool, isSpecifier bool) { // Checks if the string literal at i is a script URL or a module specifier
+	before := significantJSTokens(tokens, i, -1, 3)
+	after := significantJSTokens(tokens, i, 1, 1)
+	standalone := len(after) == 1 && (after[0].Type == js.CloseParenToken || after[0].Type == js.CommaToken) // The string isn't part of a larger expression
+	switch {
+	case len(before) >= 1 && before[0].Type == js.ImportToken: // import "x"
+		return false, true
+	case len(before) >= 1 && before[0].Type == js.FromToken: // import x from "x" and export x from "x"
+		return false, isModuleDeclaration(tokens, i)
+	case len(before) >= 2 && before[0].Type == js.OpenParenToken && before[1].Type == js.ImportToken: // import("x")
+		return false, standalone
+	case len(before) >= 3 && before[0].Type == js.OpenParenToken && before[2].Type == js.NewToken: // new Worker("x"), new SharedWorker("x") and new URL("x", import.meta.url)
+		switch string(before[1].Data) {
+		case "Worker", "SharedWorker":
+			return standalone, false
+		case "URL":
+			return isImportMetaURL(significantJSTokens(tokens, i, 1, 6)), false
+		}
+		return false, false
+	}
+	for j := i - 1; j >= 0; j-- { // importScripts("x", "y")
+		if isJSSpace(tokens[j].Type) || tokens[j].Type == js.StringToken || tokens[j].Type == js.CommaToken {
+			continue
+		}
+		if tokens[j].Type != js.OpenParenToken {
+			return false, false
+		}
+		name := significantJSTokens(tokens, j, -1, 1)
+		return standalone && len(name) == 1 && string(name[0].Data) == "importScripts", false
+	}
+	return false, false
+}
+
+func isModuleDeclaration(tokens []jsToken, i int) bool { // Checks if the token at i belongs to an import or export declaration
+	for j := i - 1; j >= 0; j-- {
+		switch tokens[j].Type {
+		case js.ImportToken, js.ExportToken:
+			return true
+		case js.SemicolonToken, js.EqToken, js.OpenParenToken:
+			return false
+		}
+	}
+	return false
+}
+
+func isImportMetaURL(tokens []jsToken) bool { // Checks if tokens are ", import.meta.url"
+	expected := []string{",", "import", ".", "meta", ".", "url"}
+	if len(tokens) != len(expected) {
+		return false
+	}
+	for i := range tokens {
+		if string(tokens[i].Data) != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func significantJSTokens(tokens []jsToken, i int, step int, n int) []jsToken { // Collect up to n tokens that aren't whitespace or comments, walking from i in the direction of step
+	var found []jsToken
+	for j := i + step; j >= 0 && j < len(tokens) && len(found) < n; j += step {
+		if !isJSSpace(tokens[j].Type) {
+			found = append(found, tokens[j])
+		}
+	}
+	return found
+}
+
+func formatJSString(literal []byte, isSpecifier bool, baseURL string, link *linkBase) (string, bool) { // Format the URL in a string literal, keeping its quotes
+	quote := literal[0]
+	rawurl := string(literal[1 : len(literal)-1])
+	if strings.ContainsRune(rawurl, '\\') { // Escaped strings are rare enough here that we leave them alone
+		return "", false
+	}
+	if isSpecifier && !isURLSpecifier(rawurl) {
+		return "", false
+	}
+	formatted, err := formatURI(rawurl, baseURL, link)
+	if err != nil {
+		return "", false
+	}
+	return string(quote) + formatted + string(quote), true
+}
+
+func isURLSpecifier(specifier string) bool { // Checks if a module specifier is a URL, rather than a bare specifier that's resolved with an import map
+	return strings.HasPrefix(specifier, "/") || strings.HasPrefix(specifier, "./") || strings.HasPrefix(specifier, "../") ||
+		strings.HasPrefix(specifier, "http://") || strings.HasPrefix(specifier, "https://")
+}
+
+func modifyImportMap(source string, baseURL string, link *linkBase) (string, error) { // Modify the URLs in an import map
+	var imports importMap
+	err := json.Unmarshal([]byte(source), &imports)
+	if err != nil {
+		return "", err
+	}
+
+	imports.Imports = modifySpecifierMap(imports.Imports, baseURL, link)
+	for scope, specifiers := range imports.Scopes { // Scope prefixes are left alone, proxied URLs can't be matched against them
+		imports.Scopes[scope] = modifySpecifierMap(specifiers, baseURL, link)
+	}
+	if config.StripIntegrityAttributes {
+		imports.Integrity = nil
+	} else if imports.Integrity != nil {
+		integrity := make(map[string]string, len(imports.Integrity))
+		for src, metadata := range imports.Integrity {
+			integrity[formatImportMapURL(src, baseURL, link)] = metadata
+		}
+		imports.Integrity = integrity
+	}
+
+	modified, err := json.Marshal(imports)
+	if err != nil {
+		return "", err
+	}
+	return string(modified), nil
+}
+
+func modifySpecifierMap(specifiers map[string]string, baseURL string, link *linkBase) map[string]string { // Modify the URLs in a single specifier map
+	if specifiers == nil {
+		return nil
+	}
+	modified := make(map[string]string, len(specifiers))
+	for specifier, target := range specifiers {
+		if strings.HasSuffix(specifier, "/") { // Prefix mappings get the rest of the specifier appended to them, which doesn't work with an encoded URL
+			modified[specifier] = target
+			continue
+		}
+		if isURLSpecifier(specifier) { // Imports of URLs are rewritten, so the keys they're matched against have to be too
+			specifier = formatImportMapURL(specifier, baseURL, link)
+		}
+		modified[specifier] = formatImportMapURL(target, baseURL, link)
+	}
+	return modified
+}
+
+func formatImportMapURL(rawurl string, baseURL string, link *linkBase) string { // Format a URL in an import map, leaving it alone if we can't
+	formatted, err := formatURI(rawurl, baseURL, link)
+	if err != nil {
+		return rawurl
+	}
+	return formatted
+}
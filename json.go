@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+)
+
+type jsonContainer struct { // The jsonContainer type keeps track of an object or array while it's being re-encoded
+	Object    bool   // Whether the container is an object (as opposed to an array)
+	Count     int    // Number of values (or key/value pairs) written so far
+	ExpectKey bool   // Whether the next string in an object is a key
+	Key       string // The key of the value being written, if the container is an object
+}
+
+var jsonURLKeySuffixes = []string{"url", "uri", "href", "src", "link"} // Keys whose values may hold relative URLs, and not just absolute ones
+
+func modifyJSON(body string, baseURL string, link *linkBase) (string, error) { // Modify URLs in JSON string values, keeping the order of everything else
+	return rewriteJSON(body, func(key string, val string, depth int) string {
+		if !looksLikeJSONURL(key, val) {
+			return val
+		}
+		formatted, err := formatURI(val, baseURL, link)
+		if err != nil {
+			return val
+		}
+		return formatted
+	})
+}
+
+func rewriteJSON(body string, rewrite func(key string, val string, depth int) string) (string, error) { // Re-encode a JSON document token by token, passing every string value (along with its key, and how many objects and arrays it's in) through rewrite
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber() // Numbers are kept exactly as they were written
+	var buf bytes.Buffer
+	var stack []*jsonContainer
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		var parent *jsonContainer
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			buf.WriteRune(rune(delim))
+			continue
+		}
+
+		if parent != nil {
+			if parent.Count > 0 && (!parent.Object || parent.ExpectKey) {
+				buf.WriteByte(',')
+			}
+			if parent.Object && parent.ExpectKey { // Keys are always strings, and are never rewritten
+				parent.Key, _ = token.(string)
+				parent.ExpectKey = false
+				writeJSONString(&buf, parent.Key)
+				buf.WriteByte(':')
+				continue
+			}
+			parent.Count++
+			parent.ExpectKey = parent.Object
+		}
+
+		switch val := token.(type) {
+		case json.Delim:
+			buf.WriteRune(rune(val))
+			stack = append(stack, &jsonContainer{Object: val == '{', ExpectKey: val == '{'})
+		case string:
+			key := ""
+			if parent != nil && parent.Object {
+				key = parent.Key
+			}
+			writeJSONString(&buf, rewrite(key, val, len(stack)))
+		case json.Number:
+			buf.WriteString(val.String())
+		case bool:
+			if val {
+				buf.WriteString("true")
+			} else {
+				buf.WriteString("false")
+			}
+		case nil:
+			buf.WriteString("null")
+		}
+	}
+	return buf.String(), nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) { // Write a JSON string without escaping HTML characters
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	buf.Truncate(buf.Len() - 1) // Encode always adds a newline
+}
+
+func looksLikeJSONURL(key string, val string) bool { // Heuristically check if a JSON string value is a URL
+	if strings.HasPrefix(val, "http://") || strings.HasPrefix(val, "https://") {
+		_, err := url.Parse(val)
+		return err == nil && !strings.ContainsAny(val, " \t\n")
+	}
+	if !strings.HasPrefix(val, "/") || strings.ContainsAny(val, " \t\n") { // Relative URLs are only trusted when the key says that the value is a URL
+		return false
+	}
+	key = strings.ToLower(key)
+	for _, suffix := range jsonURLKeySuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonDomainAllowed(baseURL string) bool { // Checks if JSON from baseURL should be modified, according to config.JSONDomains
+	if len(config.JSONDomains) == 0 {
+		return true
+	}
+	parsedurl, err := url.Parse(baseURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(parsedurl.Hostname())
+	for _, domain := range config.JSONDomains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
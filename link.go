@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+)
+
+var manifestURLKeys = map[string]bool{ // Keys that hold URLs in web app manifests (the members of icons, screenshots and shortcuts included)
+	"start_url": true, "src": true, "url": true,
+}
+
+var manifestTopLevelURLKeys = map[string]bool{ // Keys that only hold URLs at the top level of a manifest (eg. related_applications have ids that aren't URLs)
+	"scope": true, "id": true, // These have to be rewritten like start_url, or it falls outside of the scope and the browser ignores it
+}
+
+func modifyLinkHeader(header string, baseURL string, link *linkBase) string { // Modify the target of every link in an RFC 8288 Link header
+	values := splitLinkHeader(header)
+	for i, value := range values {
+		trimmed := strings.TrimLeft(value, " \t")
+		end := strings.IndexByte(trimmed, '>')
+		if !strings.HasPrefix(trimmed, "<") || end < 0 { // Not a valid link-value, so leave it alone
+			continue
+		}
+		formatted, err := formatURI(trimmed[1:end], baseURL, link)
+		if err != nil {
+			continue
+		}
+		values[i] = value[:len(value)-len(trimmed)] + "<" + formatted + ">" + trimmed[end+1:] // Parameters (like rel) are kept as they were
+	}
+	return strings.Join(values, ",")
+}
+
+func splitLinkHeader(header string) []string { // Split a Link header into link-values, on commas that aren't inside a URI reference or quoted string
+	var values []string
+	inURI, inQuotes, escaped := false, false, false
+	start := 0
+	for i := 0; i < len(header); i++ {
+		switch c := header[i]; {
+		case escaped:
+			escaped = false
+		case inQuotes && c == '\\':
+			escaped = true
+		case c == '"' && !inURI:
+			inQuotes = !inQuotes
+		case c == '<' && !inQuotes:
+			inURI = true
+		case c == '>' && !inQuotes:
+			inURI = false
+		case c == ',' && !inURI && !inQuotes:
+			values = append(values, header[start:i])
+			start = i + 1
+		}
+	}
+	return append(values, header[start:])
+}
+
+func modifyManifest(body string, baseURL string, link *linkBase) (string, error) { // Modify the start URL, scope, ID, icons, screenshots and shortcuts in a web app manifest
+	return rewriteJSON(body, func(key string, val string, depth int) string {
+		if !manifestURLKeys[key] && !(depth == 1 && manifestTopLevelURLKeys[key]) {
+			return val
+		}
+		formatted, err := formatURI(val, baseURL, link)
+		if err != nil {
+			return val
+		}
+		return formatted
+	})
+}
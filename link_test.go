@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestModifyManifest(t *testing.T) {
+	manifest := `{
+		"name": "App",
+		"id": "/app/?source=pwa",
+		"start_url": "/app/index.html",
+		"scope": "/app/",
+		"icons": [{"src": "icon.png", "sizes": "192x192"}],
+		"shortcuts": [{"name": "New", "url": "/app/new"}],
+		"related_applications": [{"platform": "play", "id": "com.example.app"}]
+	}`
+	modified, err := modifyManifest(manifest, "https://example.com/app/manifest.json", testLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Name      string
+		ID        string
+		StartURL  string `json:"start_url"`
+		Scope     string
+		Icons     []struct{ Src string }
+		Shortcuts []struct{ URL string }
+		Related   []struct{ ID string } `json:"related_applications"`
+	}
+	err = json.Unmarshal([]byte(modified), &got)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, modified)
+	}
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"name", got.Name, "App"},
+		{"id", got.ID, testProxied("https://example.com/app/?source=pwa")},
+		{"start_url", got.StartURL, testProxied("https://example.com/app/index.html")},
+		{"scope", got.Scope, testProxied("https://example.com/app/")},
+		{"icon", got.Icons[0].Src, testProxied("https://example.com/app/icon.png")},
+		{"shortcut", got.Shortcuts[0].URL, testProxied("https://example.com/app/new")},
+		{"related application", got.Related[0].ID, "com.example.app"}, // Not a URL
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s is %q, want %q", test.name, test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type accessRecord struct { // The accessRecord type holds what handlers learn about a request that the access log needs, since they see it after the log's middleware does
+	ID      string // ID of the request, which is also in the X-Request-ID header of the response
+	User    string // User that made the request, if it was authenticated
+	Proxied bool   // Whether the request was to the proxy, so its URL holds a target that may need redacting
+	Target  string // URL that was proxied, if it could be decoded
+	Host    string // Host that was proxied, once it's been normalized, which is kept out of logged error messages
+	Route   string // Pattern of the handler that the request was routed to, for metrics
+}
+
+type accessRecordKey struct{} // Context key for a request's accessRecord
+
+type loggingResponseWriter struct { // The loggingResponseWriter type counts the status and bytes of a response for the access log
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+
+func (writer *loggingResponseWriter) WriteHeader(status int) {
+	if writer.Status == 0 {
+		writer.Status = status
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *loggingResponseWriter) Write(data []byte) (int, error) {
+	if writer.Status == 0 {
+		writer.Status = http.StatusOK
+	}
+	n, err := writer.ResponseWriter.Write(data)
+	writer.Bytes += int64(n)
+	return n, err
+}
+
+func (writer *loggingResponseWriter) Flush() { // Streamed responses need to be flushed through us
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (writer *loggingResponseWriter) Unwrap() http.ResponseWriter { // Lets http.ResponseController reach the underlying writer
+	return writer.ResponseWriter
+}
+
+var accessLog io.Writer       // Where the access log is written to, nil if it's off
+var accessLogMutex sync.Mutex // Lines of the access log mustn't be interleaved
+
+func setupLogging() error { // Set up the default logger and the access log from the log flags
+	var level slog.Level
+	err := level.UnmarshalText([]byte(config.LogLevel))
+	if err != nil {
+		return errors.New("log-level must be debug, info, warn or error")
+	}
+	options := &slog.HandlerOptions{Level: level}
+	if config.LogFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	}
+
+	switch config.AccessLog {
+	case "":
+		accessLog = nil
+	case "-":
+		accessLog = os.Stdout
+	default:
+		file, err := os.OpenFile(config.AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		accessLog = file
+	}
+	return nil
+}
+
+func withRequestLogging(handler http.Handler) http.Handler { // Give every request an ID, and write it to the access log once it's been handled
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		record := &accessRecord{ID: reqHTTP.Header.Get("X-Request-ID")}
+		if record.ID == "" || len(record.ID) > 64 || !isTrustedProxy(reqHTTP.RemoteAddr) { // Only reverse proxies we trust get to pick the ID, so that it can be used to follow a request through them
+			record.ID = randomString()[:16]
+		}
+		resWriter.Header().Set("X-Request-ID", record.ID)
+
+		start := time.Now()
+		writer := &loggingResponseWriter{ResponseWriter: resWriter}
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec() // Even if the handler panics
+		handler.ServeHTTP(writer, reqHTTP.WithContext(context.WithValue(reqHTTP.Context(), accessRecordKey{}, record)))
+		observeRequest(record, writer)
+		if accessLog != nil {
+			writeAccessLog(reqHTTP, writer, record, time.Since(start))
+		}
+	})
+}
+
+func withRoute(mux *http.ServeMux) http.Handler { // Note which of mux's handlers a request goes to, once any base path has been stripped from it
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		_, requestRecord(reqHTTP).Route = mux.Handler(reqHTTP)
+		mux.ServeHTTP(resWriter, reqHTTP)
+	})
+}
+
+func requestRecord(reqHTTP *http.Request) *accessRecord { // Get the access log record of a request, which is never nil so that handlers don't have to check
+	if record, ok := reqHTTP.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		return record
+	}
+	return &accessRecord{}
+}
+
+func requestLogger(reqHTTP *http.Request) *slog.Logger { // Get a logger for a request, which tags everything with its ID (and trace, if it's being traced)
+	logger := slog.Default()
+	if record := requestRecord(reqHTTP); record.ID != "" {
+		logger = logger.With("request_id", record.ID)
+	}
+	if spanContext := trace.SpanContextFromContext(reqHTTP.Context()); spanContext.IsSampled() {
+		logger = logger.With("trace_id", spanContext.TraceID().String())
+	}
+	return logger
+}
+
+func writeAccessLog(reqHTTP *http.Request, writer *loggingResponseWriter, record *accessRecord, duration time.Duration) {
+	status := writer.Status
+	if status == 0 { // Nothing was written, which net/http turns into an empty 200
+		status = http.StatusOK
+	}
+	uri := reqHTTP.URL.RequestURI()
+	if record.Proxied { // The URL holds the (encoded) target, which is redacted like any other URL
+		path := reqHTTP.URL.EscapedPath()
+		uri = strings.TrimSuffix(path, proxyPathRest(reqHTTP.URL))
+		if record.Target != "" {
+			uri += redactURL(record.Target)
+		}
+	}
+	remote := clientIP(reqHTTP)
+
+	var line []byte
+	var err error
+	if config.AccessLogFormat == "json" {
+		line, err = json.Marshal(struct {
+			Time      string  `json:"time"`
+			RequestID string  `json:"request_id"`
+			Remote    string  `json:"remote"`
+			User      string  `json:"user,omitempty"`
+			Method    string  `json:"method"`
+			URI       string  `json:"uri"`
+			Proto     string  `json:"proto"`
+			Status    int     `json:"status"`
+			Bytes     int64   `json:"bytes"`
+			Duration  float64 `json:"duration_ms"`
+		}{time.Now().Format(time.RFC3339Nano), record.ID, remote, record.User, reqHTTP.Method, uri, reqHTTP.Proto, status, writer.Bytes, float64(duration.Microseconds()) / 1000})
+		if err != nil {
+			slog.Error("couldn't write the access log", "error", err)
+			return
+		}
+	} else { // Common Log Format, which has no room for the request ID or duration
+		user := record.User
+		if user == "" {
+			user = "-"
+		}
+		line = []byte(remote + " - " + strings.Replace(user, " ", "_", -1) + " [" + time.Now().Format("02/Jan/2006:15:04:05 -0700") + "] " +
+			strconv.Quote(reqHTTP.Method+" "+uri+" "+reqHTTP.Proto) + " " + strconv.Itoa(status) + " " + strconv.FormatInt(writer.Bytes, 10))
+	}
+
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	_, err = accessLog.Write(append(line, '\n'))
+	if err != nil {
+		slog.Error("couldn't write the access log", "error", err)
+	}
+}
+
+func redactError(err error) string { // Get the message of an error, with the URL redacted if it came from an HTTP client
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Op + " " + strconv.Quote(redactURL(urlErr.URL)) + ": " + urlErr.Err.Error()
+	}
+	return err.Error()
+}
+
+func redactMessage(reqHTTP *http.Request, message string) string { // Take the proxied host out of an error message before it's logged, since the error logged with it has the URL redacted already
+	if host := requestRecord(reqHTTP).Host; host != "" {
+		return strings.Replace(message, host, "[host]", -1)
+	}
+	return message
+}
+
+func redactURL(rawurl string) string { // Hide as much of a proxied URL as log-redact says to, for the privacy of the people using Bypass
+	switch config.LogRedact {
+	case "none":
+		return rawurl
+	case "all":
+		return "[redacted]"
+	}
+	parsedURL, err := url.Parse(rawurl)
+	if err != nil {
+		return "[unparseable]"
+	}
+	parsedURL.User = nil
+	parsedURL.RawQuery, parsedURL.Fragment, parsedURL.RawFragment = "", "", ""
+	parsedURL.ForceQuery = false
+	if config.LogRedact == "host" {
+		parsedURL.Path, parsedURL.RawPath = "", ""
+	}
+	return parsedURL.String()
+}
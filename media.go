@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var hlsURIRegexp = regexp.MustCompile(`URI="([^"]*)"`) // Regular expression for matching URI attributes in HLS tags (eg. #EXT-X-KEY)
+
+var dashURLAttributes = map[string]bool{ // Attributes that hold URLs (or URL templates) in DASH manifests
+	"media": true, "initialization": true, "index": true, "sourceURL": true, "href": true,
+}
+
+var dashURLElements = map[string]bool{ // Elements whose text is a URL in DASH manifests
+	"BaseURL": true, "Location": true, "PatchLocation": true,
+}
+
+var dashBaseElements = map[string]bool{ // Elements that set the base URL for their siblings, like an xml:base attribute on their parent
+	"BaseURL": true,
+}
+
+func modifyHLS(body string, baseURL string, link *linkBase) (string, error) { // Modify the segment, key and variant URLs in an HLS playlist
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "#EXT"): // Tags can hold URLs in their URI attribute
+			lines[i] = hlsURIRegexp.ReplaceAllStringFunc(line, func(attr string) string {
+				formatted, err := formatURI(hlsURIRegexp.FindStringSubmatch(attr)[1], baseURL, link)
+				if err != nil {
+					return attr
+				}
+				return `URI="` + formatted + `"`
+			})
+		case strings.HasPrefix(trimmed, "#"): // Comments
+			continue
+		default: // Every other line is the URL of a segment or a variant playlist
+			formatted, err := formatURI(trimmed, baseURL, link)
+			if err == nil {
+				lines[i] = strings.Replace(line, trimmed, formatted, 1)
+			}
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func modifyDASH(body string, baseURL string, link *linkBase) (string, error) { // Modify the segment and base URLs in a DASH manifest
+	rewriter := &xmlRewriter{BaseURL: baseURL, Link: link, URLAttributes: dashURLAttributes, URLElements: dashURLElements, BaseElements: dashBaseElements, Format: formatTemplateURI}
+	return rewriter.Rewrite(body)
+}
+
+func formatTemplateURI(rawurl string, host string, link *linkBase) (string, error) { // Format a URL that may hold DASH template identifiers (eg. $Number$), which the player fills in after we've encoded it
+	resolved, err := url.Parse(host)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	full := resolved.ResolveReference(ref).String()
+	full = strings.Replace(full, "%24", "$", -1) // Resolving the reference escapes the identifiers' dollar signs
+
+	identifier := strings.Index(full, "$")
+	if identifier < 0 {
+		return formatURI(rawurl, host, link)
+	}
+	if !codec.Opaque() { // The player can fill in the identifiers of a readable URL as it is
+		formatted, err := proxiedURL(full, link)
+		return strings.Replace(formatted, "%24", "$", -1), err
+	}
+	formatted, err := formatURI(full[:identifier], host, link)
+	if err != nil {
+		return "", err
+	}
+	separator := "?"
+	if strings.Contains(formatted, "?") {
+		separator = "&"
+	}
+	// Everything from the first identifier onwards goes in the s parameter, with
+	// the identifiers left unencoded so that the player can still replace them
+	parts := strings.Split(full[identifier:], "$")
+	for i := 0; i < len(parts); i += 2 { // Even parts are outside of identifiers
+		parts[i] = url.QueryEscape(parts[i])
+	}
+	return formatted + separator + "s=" + strings.Join(parts, "$"), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metrics = prometheus.NewRegistry() // Registry for everything on /metrics
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bypass_requests_total",
+		Help: "Requests handled, by route, status code and the type of content that was sent back.",
+	}, []string{"route", "code", "content_type"})
+	requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bypass_requests_in_flight",
+		Help: "Requests that are being handled right now.",
+	})
+	responseBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bypass_response_bytes_total",
+		Help: "Bytes of response bodies sent to clients, by route.",
+	}, []string{"route"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bypass_upstream_duration_seconds",
+		Help:    "Time until upstream hosts started responding, by status class (or error).",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2.5, 10),
+	}, []string{"class"})
+	upstreamBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bypass_upstream_bytes_total",
+		Help: "Bytes of response bodies read from upstream hosts.",
+	})
+	rewriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bypass_rewrite_duration_seconds",
+		Help:    "Time spent rewriting responses, by transformer (HTML is rewritten as it streams in, so it includes reading the body).",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 3, 10),
+	}, []string{"transformer"})
+	staticCacheTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bypass_static_cache_requests_total",
+		Help: "Lookups of cached static files (eg. the 404 page), by whether they were cached.",
+	}, []string{"result"})
+	ssrfBlockedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bypass_ssrf_blocked_total",
+		Help: "Proxy requests that were refused to stop server-side request forgery, by what gave them away.",
+	}, []string{"reason"})
+)
+
+func init() {
+	metrics.MustRegister(requestsTotal, requestsInFlight, responseBytesTotal, upstreamDuration, upstreamBytesTotal, rewriteDuration, staticCacheTotal, ssrfBlockedTotal)
+	metrics.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metrics.MustRegister(limiterCollector{}, upstreamCollector{})
+}
+
+func metricsHandler() http.Handler { // Serve everything in the registry
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
+
+func observeRequest(record *accessRecord, writer *loggingResponseWriter) { // Count a request that has been handled
+	status := writer.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	route := record.Route
+	if route == "" {
+		route = "none"
+	}
+	requestsTotal.WithLabelValues(route, strconv.Itoa(status), contentTypeClass(writer.Header().Get("Content-Type"))).Inc()
+	responseBytesTotal.WithLabelValues(route).Add(float64(writer.Bytes))
+}
+
+func contentTypeClass(header string) string { // Sort a Content-Type into one of a few classes, since upstream hosts can send anything
+	mimeType := strings.ToLower(strings.TrimSpace(strings.SplitN(header, ";", 2)[0]))
+	switch {
+	case mimeType == "":
+		return "none"
+	case mimeType == "text/html", mimeType == "text/css", mimeType == "text/plain":
+		return mimeType
+	case strings.Contains(mimeType, "javascript") || strings.Contains(mimeType, "ecmascript"):
+		return "javascript"
+	case strings.Contains(mimeType, "json"):
+		return "json"
+	case strings.Contains(mimeType, "xml"):
+		return "xml"
+	case strings.Contains(mimeType, "mpegurl"):
+		return "hls"
+	}
+	major := strings.SplitN(mimeType, "/", 2)[0]
+	switch major {
+	case "image", "video", "audio", "font":
+		return major
+	}
+	return "other"
+}
+
+func timedTransformer(name string, transform transformer) transformer { // Record how long a transformer takes
+	return func(body string, baseURL string, link *linkBase) (string, error) {
+		start := time.Now()
+		defer func() { rewriteDuration.WithLabelValues(name).Observe(time.Since(start).Seconds()) }()
+		return transform(body, baseURL, link)
+	}
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+type countingReader struct { // The countingReader type counts the bytes of an upstream response body as they're read
+	io.ReadCloser
+}
+
+func (reader countingReader) Read(data []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(data)
+	upstreamBytesTotal.Add(float64(n))
+	return n, err
+}
+
+type limiterCollector struct{} // The limiterCollector type exposes the state of the rate limiters
+
+var (
+	limiterClientsDesc  = prometheus.NewDesc("bypass_ratelimit_clients", "Clients that have made a request recently, by route.", []string{"route"}, nil)
+	limiterActiveDesc   = prometheus.NewDesc("bypass_ratelimit_active_requests", "Requests in progress that count towards concurrency limits, by route.", []string{"route"}, nil)
+	limiterRejectedDesc = prometheus.NewDesc("bypass_ratelimit_rejected_total", "Requests rejected for going over a limit, by route and limit.", []string{"route", "limit"}, nil)
+)
+
+func (limiterCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- limiterClientsDesc
+	descs <- limiterActiveDesc
+	descs <- limiterRejectedDesc
+}
+
+func (limiterCollector) Collect(collected chan<- prometheus.Metric) {
+	for route, limiter := range rateLimiters {
+		stats := limiter.Stats()
+		collected <- prometheus.MustNewConstMetric(limiterClientsDesc, prometheus.GaugeValue, float64(stats.Clients), route)
+		collected <- prometheus.MustNewConstMetric(limiterActiveDesc, prometheus.GaugeValue, float64(stats.Active), route)
+		collected <- prometheus.MustNewConstMetric(limiterRejectedDesc, prometheus.CounterValue, float64(stats.RateRejected), route, "rate")
+		collected <- prometheus.MustNewConstMetric(limiterRejectedDesc, prometheus.CounterValue, float64(stats.ConcurrencyRejected), route, "concurrent")
+	}
+}
+
+type upstreamCollector struct{} // The upstreamCollector type exposes how many upstream hosts are in each circuit breaker state, since there are too many hosts to label them individually
+
+var upstreamBreakersDesc = prometheus.NewDesc("bypass_upstream_breakers", "Upstream hosts that have been requested from recently, by the state of their circuit breaker.", []string{"state"}, nil)
+
+func (upstreamCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- upstreamBreakersDesc
+}
+
+func (upstreamCollector) Collect(collected chan<- prometheus.Metric) {
+	counts := map[breakerState]int{breakerClosed: 0, breakerOpen: 0, breakerHalfOpen: 0}
+	for _, status := range upstreamStatuses() {
+		counts[status.State]++
+	}
+	for state, count := range counts {
+		collected <- prometheus.MustNewConstMetric(upstreamBreakersDesc, prometheus.GaugeValue, float64(count), state.String())
+	}
+}
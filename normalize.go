@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+var urlSchemeRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`) // Regular expression for matching the scheme at the start of a URL
+
+var specialSchemes = map[string]string{ // Schemes that the URL Standard parses hosts and paths for, and their default ports
+	"http": "80", "https": "443", "ws": "80", "wss": "443", "ftp": "21", "file": "",
+}
+
+// Hosts are mapped like browsers map them, which is more lenient than DNS
+var hostProfile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.StrictDomainName(false), idna.CheckHyphens(false), idna.CheckJoiners(true), idna.BidiRule(), idna.VerifyDNSLength(false))
+
+func cleanURL(rawurl string) string { // Clean up a URL the way that browsers do before parsing it, percent-encoding anything that url.Parse would choke on or treat differently
+	rawurl = strings.TrimFunc(rawurl, func(r rune) bool { return r <= ' ' }) // Leading and trailing C0 controls and spaces
+	rawurl = strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(rawurl)
+
+	scheme := strings.ToLower(strings.TrimSuffix(urlSchemeRegexp.FindString(rawurl), ":"))
+	_, special := specialSchemes[scheme]
+	if scheme != "" && !special { // Opaque URLs (like mailto:) are left to their own rules
+		return rawurl
+	}
+
+	var fragment, query string
+	if i := strings.IndexByte(rawurl, '#'); i >= 0 {
+		rawurl, fragment = rawurl[:i], rawurl[i:]
+	}
+	if i := strings.IndexByte(rawurl, '?'); i >= 0 {
+		rawurl, query = rawurl[:i], rawurl[i:]
+	}
+	rawurl = strings.Replace(rawurl, `\`, "/", -1) // Backslashes are slashes in special URLs (and in relative URLs, which we assume are http)
+
+	return percentEncode(rawurl, ` "<>`+"`{}") + percentEncode(query, ` "<>'`) + percentEncode(fragment, ` "<>`+"`")
+}
+
+func percentEncode(s string, set string) string { // Percent-encode C0 controls, non-ASCII bytes and the bytes in set, keeping valid escapes as they are
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%' && (i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2])):
+			sb.WriteString("%25") // Browsers leave a lone percent sign alone, but url.Parse won't accept one
+		case c < 0x20 || c >= 0x7f || strings.IndexByte(set, c) >= 0:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func normalizeHost(parsedurl *url.URL) error { // Normalize the host and port of a URL with a special scheme, like browsers do
+	defaultPort, special := specialSchemes[parsedurl.Scheme]
+	if !special || parsedurl.Host == "" {
+		return nil
+	}
+
+	hostname, port := parsedurl.Hostname(), parsedurl.Port()
+	if port != "" {
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return errors.New("normalize: " + port + " isn't a valid port")
+		}
+		port = strconv.FormatUint(portNum, 10) // Leading zeros are dropped
+		if port == defaultPort {
+			port = ""
+		}
+	}
+
+	if strings.Contains(parsedurl.Host, "[") { // An IPv6 address
+		ip := net.ParseIP(hostname)
+		if ip == nil {
+			return errors.New("normalize: " + hostname + " isn't a valid IPv6 address")
+		}
+		hostname = "[" + ip.String() + "]"
+	} else {
+		if !utf8.ValidString(hostname) {
+			return errors.New("normalize: host isn't valid UTF-8")
+		}
+		ascii, err := hostProfile.ToASCII(hostname)
+		if err != nil {
+			return errors.New("normalize: " + err.Error())
+		}
+		if ascii == "" || strings.ContainsAny(ascii, " #%/:<>?@[\\]^|") {
+			return errors.New("normalize: " + ascii + " isn't a valid host")
+		}
+		if ip, ok, err := parseURLIPv4(ascii); err != nil {
+			return err
+		} else if ok {
+			ascii = ip
+		}
+		hostname = ascii
+	}
+
+	if port != "" {
+		hostname += ":" + port
+	}
+	parsedurl.Host = hostname
+	return nil
+}
+
+func parseURLIPv4(host string) (string, bool, error) { // Parse a host that ends in a number as an IPv4 address, which may be written in hex, octal or as fewer than four numbers (eg. 0x7f.1)
+	parts := strings.Split(host, ".")
+	if len(parts) > 1 && parts[len(parts)-1] == "" { // A trailing dot
+		parts = parts[:len(parts)-1]
+	}
+	last := parts[len(parts)-1]
+	if _, err := parseIPv4Number(last); err != nil && strings.Trim(last, "0123456789") != "" {
+		return "", false, nil // Doesn't end in a number, so it's a domain
+	}
+	if len(parts) > 4 {
+		return "", false, errors.New("normalize: " + host + " has too many parts to be an IPv4 address")
+	}
+
+	var ip uint64
+	for i, part := range parts {
+		num, err := parseIPv4Number(part)
+		if err != nil {
+			return "", false, errors.New("normalize: " + host + " isn't a valid IPv4 address")
+		}
+		if i < len(parts)-1 {
+			if num > 255 {
+				return "", false, errors.New("normalize: " + host + " isn't a valid IPv4 address")
+			}
+			ip |= num << (8 * uint(3-i))
+		} else {
+			if num >= 1<<(8*uint(5-len(parts))) {
+				return "", false, errors.New("normalize: " + host + " isn't a valid IPv4 address")
+			}
+			ip += num
+		}
+	}
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).String(), true, nil
+}
+
+func parseIPv4Number(part string) (uint64, error) { // Parse one part of an IPv4 address, which is hex if it starts with 0x and octal if it starts with 0
+	if part == "" {
+		return 0, errors.New("normalize: empty IPv4 number")
+	}
+	base := 10
+	if len(part) >= 2 && (part[:2] == "0x" || part[:2] == "0X") {
+		part, base = part[2:], 16
+		if part == "" {
+			return 0, nil
+		}
+	} else if len(part) >= 2 && part[0] == '0' {
+		part, base = part[1:], 8
+	}
+	return strconv.ParseUint(part, base, 64)
+}
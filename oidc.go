@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const oidcStateCookie = "bypass_oidc" // Name of the cookie that holds the state of a login that's in progress
+
+type oidcLogin struct { // The oidcLogin type holds what we need to finish a login once the identity provider sends the user back
+	Provider *oidc.Provider        // The identity provider, from discovery
+	Verifier *oidc.IDTokenVerifier // Verifier for ID tokens issued to us
+	OAuth    oauth2.Config         // OAuth 2.0 client configuration, without a redirect URL since that depends on the request
+	Rules    []oidcRule            // Claims that users need one of to be let in, or nil to let every user in
+}
+
+type oidcRule struct { // The oidcRule type is a claim that lets a user in if it has a certain value
+	Claim string // Name of the claim (eg. groups)
+	Value string // Value that the claim needs to be, or contain if it's a list
+}
+
+type oidcState struct { // The oidcState type is the state of a login that's in progress, kept in a signed cookie
+	State    string // Random value that the identity provider sends back to us, to stop CSRF
+	Nonce    string // Random value that has to be in the ID token, to stop replays
+	Verifier string // PKCE code verifier
+	Next     string // Where to send the user after they've logged in
+	Expiry   int64  // When the login has to be finished by
+}
+
+var oidcAuth *oidcLogin // OpenID Connect login, nil if it isn't configured
+
+func setupOIDC() (*oidcLogin, error) { // Discover the identity provider, and set up the OpenID Connect login from the oidc flags
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, config.OIDCIssuer)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := readSecret(config.OIDCClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	login := &oidcLogin{
+		Provider: provider,
+		Verifier: provider.Verifier(&oidc.Config{ClientID: config.OIDCClientID}),
+		OAuth: oauth2.Config{
+			ClientID:     config.OIDCClientID,
+			ClientSecret: secret,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, config.OIDCScopes...),
+		},
+	}
+	for _, rule := range config.OIDCAllow {
+		split := strings.SplitN(rule, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			return nil, errors.New("oidc: access rule " + rule + " should look like claim=value")
+		}
+		login.Rules = append(login.Rules, oidcRule{Claim: split[0], Value: split[1]})
+	}
+	return login, nil
+}
+
+func (login *oidcLogin) oauthConfig(proxyURL string) *oauth2.Config { // Get the OAuth 2.0 configuration for a request, which the identity provider sends users back to
+	oauthConfig := login.OAuth
+	oauthConfig.RedirectURL = strings.TrimSuffix(proxyURL, "/") + "/oidc/callback"
+	return &oauthConfig
+}
+
+func (login *oidcLogin) allowed(claims map[string]interface{}) bool { // Check if a user's claims match any of the access rules
+	if len(login.Rules) == 0 {
+		return true
+	}
+	for _, rule := range login.Rules {
+		switch value := claims[rule.Claim].(type) {
+		case []interface{}: // eg. groups
+			for _, item := range value {
+				if fmt.Sprint(item) == rule.Value {
+					return true
+				}
+			}
+		case nil:
+			continue
+		default: // Strings, booleans and numbers
+			if fmt.Sprint(value) == rule.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func oidcLoginHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqError { // Handle requests to /oidc/login, which send the user to the identity provider
+	externalURL, err := requestExternalURL(reqHTTP)
+	if err != nil {
+		return &reqError{err, "Bypass isn't served from this host.", 400}
+	}
+
+	state := oidcState{State: randomString(), Nonce: randomString(), Verifier: oauth2.GenerateVerifier(), Next: reqHTTP.URL.Query().Get("next"), Expiry: time.Now().Add(10 * time.Minute).Unix()}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return &reqError{err, "Couldn't start logging in.", 500}
+	}
+	value := base64.RawURLEncoding.EncodeToString(encoded)
+	http.SetCookie(resWriter, &http.Cookie{Name: oidcStateCookie, Value: value + "." + loginSessions.sign(value), Path: externalPath(externalURL) + "oidc/", MaxAge: 600, HttpOnly: true, SameSite: http.SameSiteLaxMode}) // Lax cookies are still sent when the identity provider redirects back to us
+
+	authURL := oidcAuth.oauthConfig(externalURL).AuthCodeURL(state.State, oidc.Nonce(state.Nonce), oauth2.S256ChallengeOption(state.Verifier))
+	http.Redirect(resWriter, reqHTTP, authURL, http.StatusFound)
+	return nil
+}
+
+func oidcCallbackHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqError { // Handle requests to /oidc/callback, where the identity provider sends the user back to
+	externalURL, err := requestExternalURL(reqHTTP)
+	if err != nil {
+		return &reqError{err, "Bypass isn't served from this host.", 400}
+	}
+	if errCode := reqHTTP.URL.Query().Get("error"); errCode != "" {
+		return &reqError{errors.New(errCode + ": " + reqHTTP.URL.Query().Get("error_description")), "The identity provider didn't log you in.", 403}
+	}
+
+	cookie, err := reqHTTP.Cookie(oidcStateCookie)
+	if err != nil {
+		return &reqError{err, "Your login expired, please try again.", 400}
+	}
+	http.SetCookie(resWriter, &http.Cookie{Name: oidcStateCookie, Path: externalPath(externalURL) + "oidc/", MaxAge: -1}) // The state can only be used once
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(loginSessions.sign(parts[0]))) {
+		return &reqError{nil, "Your login was tampered with, please try again.", 400}
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return &reqError{err, "Your login was tampered with, please try again.", 400}
+	}
+	var state oidcState
+	err = json.Unmarshal(encoded, &state)
+	if err != nil || time.Now().Unix() > state.Expiry || reqHTTP.URL.Query().Get("state") != state.State {
+		return &reqError{err, "Your login expired, please try again.", 400}
+	}
+
+	ctx, cancel := context.WithTimeout(reqHTTP.Context(), 30*time.Second)
+	defer cancel()
+	token, err := oidcAuth.oauthConfig(externalURL).Exchange(ctx, reqHTTP.URL.Query().Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		return &reqError{err, "Couldn't get a token from the identity provider.", 502}
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return &reqError{nil, "The identity provider didn't send an ID token.", 502}
+	}
+	idToken, err := oidcAuth.Verifier.Verify(ctx, rawIDToken) // Checks the signature, issuer, audience and expiry
+	if err != nil {
+		return &reqError{err, "The identity provider sent an invalid ID token.", 502}
+	}
+	if idToken.Nonce != state.Nonce {
+		return &reqError{nil, "The identity provider sent an ID token for another login.", 400}
+	}
+
+	var claims map[string]interface{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return &reqError{err, "Couldn't read the claims in the ID token.", 502}
+	}
+	if !oidcAuth.allowed(claims) {
+		return &reqError{nil, "You aren't allowed to use Bypass.", 403}
+	}
+	user, _ := claims[config.OIDCUserClaim].(string)
+	if user == "" {
+		user = idToken.Subject
+	}
+
+	next := state.Next
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") { // Only ever redirect within Bypass
+		next = externalPath(externalURL)
+	}
+	http.SetCookie(resWriter, loginSessions.Cookie(user, externalURL))
+	http.Redirect(resWriter, reqHTTP, next, http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockProvider struct { // The mockProvider type is an OpenID Connect identity provider that issues an ID token for any code
+	*httptest.Server
+	Key    *rsa.PrivateKey // Key that ID tokens are signed with
+	Claims map[string]interface{}
+
+	Code     string // Code that the last token request exchanged
+	Verifier string // PKCE code verifier that the last token request sent
+	Nonce    string // Nonce to put in ID tokens, which tests take from the authorization URL
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &mockProvider{Key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		json.NewEncoder(resWriter).Encode(map[string]interface{}{
+			"issuer":                                provider.URL,
+			"authorization_endpoint":                provider.URL + "/authorize",
+			"token_endpoint":                        provider.URL + "/token",
+			"jwks_uri":                              provider.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		json.NewEncoder(resWriter).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		reqHTTP.ParseForm()
+		provider.Code, provider.Verifier = reqHTTP.Form.Get("code"), reqHTTP.Form.Get("code_verifier")
+		claims := map[string]interface{}{"iss": provider.URL, "aud": "bypass", "sub": "subject", "nonce": provider.Nonce, "exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix()}
+		for claim, value := range provider.Claims {
+			claims[claim] = value
+		}
+		resWriter.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resWriter).Encode(map[string]interface{}{"access_token": "access", "token_type": "Bearer", "id_token": provider.sign(t, claims)})
+	})
+	provider.Server = httptest.NewServer(mux)
+	return provider
+}
+
+func (provider *mockProvider) sign(t *testing.T, claims map[string]interface{}) string { // Make an RS256 JWT
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, provider.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func setupMockOIDC(t *testing.T, allow ...string) *mockProvider { // Set up OpenID Connect login with a mock provider, undoing it when the test is over
+	provider := newMockProvider(t)
+	saved := config
+	t.Cleanup(func() {
+		provider.Close()
+		config = saved
+		oidcAuth, loginSessions, authenticators = nil, nil, nil
+	})
+	config.OIDCIssuer, config.OIDCClientID, config.OIDCAllow, config.OIDCUserClaim = provider.URL, "bypass", allow, "email"
+	config.ExternalURL, config.ExternalURLFromRequest, config.AuthTTL = "http://proxy.test/", false, time.Hour
+	config.AuthHtpasswd, config.AuthTokens, config.AuthLogin, config.AuthCookieKey = "", "", false, ""
+	err := setupAuth() // Discovers the provider
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func startOIDCLogin(t *testing.T, provider *mockProvider, next string) (*url.URL, *http.Cookie) { // Go to /oidc/login, returning the authorization URL and state cookie
+	recorder := httptest.NewRecorder()
+	reqHandler(oidcLoginHandler).ServeHTTP(recorder, httptest.NewRequest("GET", "http://proxy.test/oidc/login?next="+url.QueryEscape(next), nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("login got status %d, want %d", recorder.Code, http.StatusFound)
+	}
+	authURL, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie {
+		t.Fatalf("login set cookies %v, want the state cookie", cookies)
+	}
+	provider.Nonce = authURL.Query().Get("nonce")
+	return authURL, cookies[0]
+}
+
+func finishOIDCLogin(state string, cookie *http.Cookie) *httptest.ResponseRecorder { // Come back to /oidc/callback like the identity provider sends users
+	reqHTTP := httptest.NewRequest("GET", "http://proxy.test/oidc/callback?code=the-code&state="+url.QueryEscape(state), nil)
+	reqHTTP.AddCookie(cookie)
+	recorder := httptest.NewRecorder()
+	reqHandler(oidcCallbackHandler).ServeHTTP(recorder, reqHTTP)
+	return recorder
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := setupMockOIDC(t, "groups=bypass")
+	provider.Claims = map[string]interface{}{"email": "user@example.com", "groups": []string{"staff", "bypass"}}
+
+	authURL, cookie := startOIDCLogin(t, provider, "/p/?u=abc")
+	query := authURL.Query()
+	if authURL.Scheme+"://"+authURL.Host+authURL.Path != provider.URL+"/authorize" {
+		t.Errorf("login redirected to %s, want the discovered authorization endpoint", authURL)
+	}
+	if query.Get("client_id") != "bypass" || query.Get("redirect_uri") != "http://proxy.test/oidc/callback" || query.Get("response_type") != "code" {
+		t.Errorf("authorization URL has the wrong client: %s", authURL)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" || query.Get("state") == "" || query.Get("nonce") == "" {
+		t.Errorf("authorization URL is missing PKCE, state or nonce: %s", authURL)
+	}
+
+	recorder := finishOIDCLogin(query.Get("state"), cookie)
+	if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != "/p/?u=abc" {
+		t.Fatalf("callback got status %d to %q, want %d to the next URL: %s", recorder.Code, recorder.Header().Get("Location"), http.StatusSeeOther, recorder.Body)
+	}
+	if provider.Code != "the-code" {
+		t.Errorf("provider was sent code %q", provider.Code)
+	}
+	sum := sha256.Sum256([]byte(provider.Verifier))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != query.Get("code_challenge") {
+		t.Errorf("code verifier %q doesn't match the code challenge", provider.Verifier)
+	}
+
+	reqHTTP := httptest.NewRequest("GET", "http://proxy.test/", nil)
+	for _, cookie := range recorder.Result().Cookies() {
+		reqHTTP.AddCookie(cookie)
+	}
+	user, ok := loginSessions.Authenticate(reqHTTP)
+	if !ok || user != "user@example.com" {
+		t.Errorf("session is for %q (%v), want user@example.com", user, ok)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(provider *mockProvider, state *string, cookie *http.Cookie)
+		status int
+	}{
+		{"wrong state", func(provider *mockProvider, state *string, cookie *http.Cookie) { *state = "forged" }, http.StatusBadRequest},
+		{"tampered cookie", func(provider *mockProvider, state *string, cookie *http.Cookie) {
+			cookie.Value = base64.RawURLEncoding.EncodeToString([]byte(`{"Next":"https://evil.example/"}`)) + cookie.Value[strings.LastIndexByte(cookie.Value, '.'):]
+		}, http.StatusBadRequest},
+		{"unsigned cookie", func(provider *mockProvider, state *string, cookie *http.Cookie) {
+			cookie.Value = cookie.Value[:strings.LastIndexByte(cookie.Value, '.')]
+		}, http.StatusBadRequest},
+		{"wrong nonce", func(provider *mockProvider, state *string, cookie *http.Cookie) { provider.Nonce = "replayed" }, http.StatusBadRequest},
+		{"wrong audience", func(provider *mockProvider, state *string, cookie *http.Cookie) {
+			provider.Claims["aud"] = "someone-else"
+		}, http.StatusBadGateway},
+		{"wrong issuer", func(provider *mockProvider, state *string, cookie *http.Cookie) {
+			provider.Claims["iss"] = "https://evil.example"
+		}, http.StatusBadGateway},
+		{"expired token", func(provider *mockProvider, state *string, cookie *http.Cookie) {
+			provider.Claims["exp"] = time.Now().Add(-time.Hour).Unix()
+		}, http.StatusBadGateway},
+		{"wrong signing key", func(provider *mockProvider, state *string, cookie *http.Cookie) {
+			provider.Key, _ = rsa.GenerateKey(rand.Reader, 2048)
+		}, http.StatusBadGateway},
+		{"not allowed", func(provider *mockProvider, state *string, cookie *http.Cookie) {
+			provider.Claims["groups"] = []string{"staff"}
+		}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := setupMockOIDC(t, "groups=bypass")
+			provider.Claims = map[string]interface{}{"email": "user@example.com", "groups": []string{"bypass"}}
+			authURL, cookie := startOIDCLogin(t, provider, "/")
+			state := authURL.Query().Get("state")
+
+			test.tamper(provider, &state, cookie)
+			recorder := finishOIDCLogin(state, cookie)
+			if recorder.Code != test.status {
+				t.Errorf("got status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			for _, cookie := range recorder.Result().Cookies() {
+				if cookie.Name == authCookie && cookie.MaxAge >= 0 {
+					t.Errorf("a session cookie was set")
+				}
+			}
+		})
+	}
+}
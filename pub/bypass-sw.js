@@ -0,0 +1,55 @@
+'use strict';
+
+// Bypass' service worker catches the requests that slip past the proxy's URL
+// rewriting (like ones made by scripts at runtime) and sends them through the
+// proxy anyway.
+
+var proxyPath = new URL("p/", self.location).pathname; // The proxy endpoint lives next to this script
+var encodePath = new URL("encode", self.location).pathname; // And so does the endpoint that formats URLs for us
+
+self.addEventListener("install", function(event) {
+  event.waitUntil(self.skipWaiting()); // Start handling requests straight away
+});
+
+self.addEventListener("activate", function(event) {
+  event.waitUntil(self.clients.claim()); // Take over pages that were loaded before we were installed
+});
+
+self.addEventListener("fetch", function(event) {
+  if (event.request.method !== "GET" || !event.clientId) { // The proxy can only make GET requests, and navigations are already rewritten
+    return;
+  }
+  var requestURL = new URL(event.request.url);
+  if (requestURL.origin === self.location.origin && (requestURL.pathname.startsWith(proxyPath) || requestURL.pathname === encodePath)) { // Already going through the proxy
+    return;
+  }
+
+  event.respondWith(self.clients.get(event.clientId).then(function(client) {
+    if (!client || !isProxied(client.url)) { // Requests from Bypass' own pages shouldn't be touched
+      return fetch(event.request);
+    }
+    return proxyURL(requestURL.href, client.url).then(function(url) {
+      return fetch(url, {credentials: "same-origin"});
+    });
+  }));
+});
+
+// Check if a page was fetched through the proxy
+function isProxied(clientURL) {
+  var url = new URL(clientURL);
+  return url.origin === self.location.origin && url.pathname.startsWith(proxyPath) && (url.pathname !== proxyPath || url.searchParams.has("u"));
+}
+
+// Format a URL that a proxied page requested so that it goes through the proxy.
+// The server does this, because the page's URL may be encrypted.
+function proxyURL(targetURL, clientURL) {
+  var body = new URLSearchParams();
+  body.set("url", targetURL);
+  body.set("base", clientURL);
+  return fetch(encodePath, {method: "POST", body: body, credentials: "same-origin"}).then(function(res) {
+    if (!res.ok) {
+      throw new Error("Bypass couldn't encode " + targetURL);
+    }
+    return res.text();
+  });
+}
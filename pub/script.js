@@ -82,15 +82,26 @@ function loadURL(targurl, inFrame) {
       });
       $("#content-frame").removeClass("hidden");
     }
-    let encodedTargetURL = window.btoa(targurl); // Encode the URL in Base64
-    let url = new URL(window.location.href);
-    url.pathname += "p/";
-    url.searchParams.set("u", encodedTargetURL);
-
-    if (inFrame) {
-      $("#content-frame").attr("src", url);
-    } else {
-      window.open(url,"_blank")
-    }
+    let tab = inFrame ? null : window.open("", "_blank"); // Pop-up blockers only allow windows opened straight away
+    let body = new URLSearchParams();
+    body.set("url", targurl);
+    // The server formats the URL, since it may need to be encrypted
+    fetch(new URL("encode", window.location.href), {method: "POST", body: body, credentials: "same-origin"}).then(function(res) {
+      if (!res.ok) {
+        throw new Error("Couldn't encode URL: " + res.status);
+      }
+      return res.text();
+    }).then(function(url) {
+      if (inFrame) {
+        $("#content-frame").attr("src", url);
+      } else {
+        tab.location = url;
+      }
+    }).catch(function(err) {
+      console.error(err);
+      if (tab) {
+        tab.close();
+      }
+    });
   }
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type limitRule struct { // The limitRule type is a flag value that holds the limits for each client of a route, like rate=10/s,burst=20,concurrent=4
+	Rate       rate.Limit // Requests per second that are let through on average, or zero for no limit
+	Burst      int        // Requests that can be made at once before Rate kicks in
+	Concurrent int        // Requests that can be in progress at once, or zero for no limit
+}
+
+func (rule *limitRule) String() string {
+	if rule.Rate == 0 && rule.Concurrent == 0 {
+		return ""
+	}
+	return "rate=" + strconv.FormatFloat(float64(rule.Rate), 'g', -1, 64) + "/s,burst=" + strconv.Itoa(rule.Burst) + ",concurrent=" + strconv.Itoa(rule.Concurrent)
+}
+
+func (rule *limitRule) Set(value string) error {
+	*rule = limitRule{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		split := strings.SplitN(pair, "=", 2)
+		if len(split) != 2 {
+			return errors.New("ratelimit: " + pair + " should look like name=value")
+		}
+		switch split[0] {
+		case "rate":
+			perSecond, err := parseRate(split[1])
+			if err != nil {
+				return err
+			}
+			rule.Rate = perSecond
+		case "burst":
+			burst, err := strconv.Atoi(split[1])
+			if err != nil || burst < 1 {
+				return errors.New("ratelimit: burst must be a positive number")
+			}
+			rule.Burst = burst
+		case "concurrent":
+			concurrent, err := strconv.Atoi(split[1])
+			if err != nil || concurrent < 0 {
+				return errors.New("ratelimit: concurrent must be a number")
+			}
+			rule.Concurrent = concurrent
+		default:
+			return errors.New("ratelimit: unknown limit " + split[0] + ", it must be rate, burst or concurrent")
+		}
+	}
+	if rule.Rate > 0 && rule.Burst == 0 { // Let at least one request through
+		rule.Burst = int(math.Max(1, math.Ceil(float64(rule.Rate))))
+	}
+	return nil
+}
+
+func parseRate(value string) (rate.Limit, error) { // Parse a rate like 10/s, 100/m or 1000/h into requests per second
+	split := strings.SplitN(value, "/", 2)
+	count, err := strconv.ParseFloat(split[0], 64)
+	if err != nil || count <= 0 {
+		return 0, errors.New("ratelimit: " + value + " isn't a valid rate")
+	}
+	per := time.Second
+	if len(split) == 2 {
+		switch split[1] {
+		case "s":
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			return 0, errors.New("ratelimit: " + value + " must be per s, m or h")
+		}
+	}
+	return rate.Limit(count / per.Seconds()), nil
+}
+
+type clientLimiter struct { // The clientLimiter type holds the limits of a single client on a route
+	Limiter  *rate.Limiter // Token bucket for the client's request rate, nil if there's no rate limit
+	Active   int           // Requests that the client has in progress
+	LastSeen time.Time     // When the client last made a request, so that idle clients can be forgotten
+}
+
+type routeLimiter struct { // The routeLimiter type enforces a limitRule for every client of a route
+	Rule    limitRule                 // The limits for each client
+	clients map[string]*clientLimiter // Clients by their key
+	mutex   sync.Mutex
+
+	rateRejected        uint64 // Requests that went over the rate limit, updated atomically
+	concurrencyRejected uint64 // Requests that went over the concurrency limit, updated atomically
+}
+
+type limiterStats struct { // The limiterStats type is a snapshot of a routeLimiter, for metrics
+	Clients             int    // Clients that have made a request recently
+	Active              int    // Requests in progress
+	RateRejected        uint64 // Requests rejected for going over the rate limit, since Bypass started
+	ConcurrencyRejected uint64 // Requests rejected for going over the concurrency limit, since Bypass started
+}
+
+var rateLimiters = make(map[string]*routeLimiter) // Limiters by the name of the route that they're for
+
+const limiterIdleTime = 10 * time.Minute // How long a client has to be idle for before its limiter is forgotten
+
+func newRouteLimiter(route string, rule limitRule) *routeLimiter { // Make a limiter for a route, or nil if the rule doesn't limit anything
+	if rule.Rate == 0 && rule.Concurrent == 0 {
+		return nil
+	}
+	limiter := &routeLimiter{Rule: rule, clients: make(map[string]*clientLimiter)}
+	rateLimiters[route] = limiter
+	go limiter.forgetIdleClients()
+	return limiter
+}
+
+func (limiter *routeLimiter) Wrap(handler http.Handler) http.Handler { // Limit how fast and how many requests each client can make to handler
+	if limiter == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		key := limiterKey(reqHTTP)
+		retryAfter, ok := limiter.acquire(key)
+		if !ok {
+			resWriter.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(resWriter, "You're making too many requests, slow down a little.", http.StatusTooManyRequests)
+			return
+		}
+		defer limiter.release(key)
+		handler.ServeHTTP(resWriter, reqHTTP)
+	})
+}
+
+func limiterKey(reqHTTP *http.Request) string { // Get the key that a client is limited by, which is their user (or API token) if they're authenticated and their IP if they aren't
+	if user := authUser(reqHTTP); user != "" {
+		return "user:" + user
+	}
+	return "ip:" + clientIP(reqHTTP)
+}
+
+func (limiter *routeLimiter) acquire(key string) (time.Duration, bool) { // Start a request for a client, returning how long they should wait for if they can't make one right now
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	client := limiter.clients[key]
+	if client == nil {
+		client = &clientLimiter{}
+		if limiter.Rule.Rate > 0 {
+			client.Limiter = rate.NewLimiter(limiter.Rule.Rate, limiter.Rule.Burst)
+		}
+		limiter.clients[key] = client
+	}
+	client.LastSeen = time.Now()
+
+	if limiter.Rule.Concurrent > 0 && client.Active >= limiter.Rule.Concurrent {
+		atomic.AddUint64(&limiter.concurrencyRejected, 1)
+		return time.Second, false // We can't know when a request will finish
+	}
+	if client.Limiter != nil {
+		reservation := client.Limiter.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel() // The request isn't going to be made, so give the token back
+			atomic.AddUint64(&limiter.rateRejected, 1)
+			return delay, false
+		}
+	}
+	client.Active++
+	return 0, true
+}
+
+func (limiter *routeLimiter) release(key string) { // Finish a request for a client
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if client := limiter.clients[key]; client != nil && client.Active > 0 {
+		client.Active--
+	}
+}
+
+func (limiter *routeLimiter) forgetIdleClients() { // Forget clients that haven't made a request in a while, so that the map doesn't grow forever
+	for range time.Tick(time.Minute) {
+		limiter.mutex.Lock()
+		for key, client := range limiter.clients {
+			if client.Active == 0 && time.Since(client.LastSeen) > limiterIdleTime {
+				delete(limiter.clients, key)
+			}
+		}
+		limiter.mutex.Unlock()
+	}
+}
+
+func (limiter *routeLimiter) Stats() limiterStats { // Get a snapshot of the limiter's state
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	stats := limiterStats{Clients: len(limiter.clients), RateRejected: atomic.LoadUint64(&limiter.rateRejected), ConcurrencyRejected: atomic.LoadUint64(&limiter.concurrencyRejected)}
+	for _, client := range limiter.clients {
+		stats.Active += client.Active
+	}
+	return stats
+}
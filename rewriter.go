@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/lukasbob/srcset"
+)
+
+type htmlRewriter struct { // The htmlRewriter type rewrites HTML in a single streaming pass, so that every URL it finds passes through the proxy
+	BaseURL string    // URL of the document being rewritten, used to resolve relative URLs
+	Link    *linkBase // Where rewritten URLs point back to
+	Depth   int       // How deeply nested (in srcdoc, template, or noscript) the document being rewritten is
+	Inject  []byte    // HTML to insert at the start of the head element, or before the first element in the body if there isn't one
+
+	openElements []string // Names of the elements that are currently open, used to find an element's parent
+	templates    int      // Number of template elements that are currently open
+	rawElement   string   // Name of the raw text element (eg. "style") whose text is about to be read
+	scriptType   string   // Type attribute of the script element whose text is about to be read
+}
+
+var voidElements = map[string]bool{ // Void elements never have an end tag, so they're never pushed onto openElements
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true,
+	"keygen": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+func (rw *htmlRewriter) Rewrite(dst io.Writer, src io.Reader) error { // Read HTML from src and write it to dst, rewriting URLs on the way
+	tokenizer := html.NewTokenizer(src)
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if tokenizer.Err() == io.EOF {
+				return nil
+			}
+			return tokenizer.Err()
+		}
+		raw := tokenizer.Raw() // Anything we don't change is written out exactly as we received it
+
+		var out []byte
+		switch tokenType {
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			raw = append([]byte(nil), raw...) // The tokenizer lowercases tag names in place, which would change the original markup
+		}
+		switch tokenType {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			var name string
+			name, out = rw.startTag(tokenizer, tokenType == html.StartTagToken)
+			if out == nil {
+				out = raw
+			}
+			if rw.Inject != nil && name != "html" { // Inject goes inside the head, or before the first element that isn't the head
+				if name == "head" {
+					out = append(out, rw.Inject...)
+				} else {
+					out = append(append([]byte(nil), rw.Inject...), out...)
+				}
+				rw.Inject = nil
+			}
+		case html.EndTagToken:
+			rw.endTag(tokenizer)
+		case html.TextToken:
+			out = rw.text(raw)
+		}
+		if out == nil {
+			out = raw
+		}
+
+		_, err := dst.Write(out)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (rw *htmlRewriter) startTag(tokenizer *html.Tokenizer, opening bool) (string, []byte) { // Rewrite the attributes of a start tag, returning a nil slice if nothing changed
+	token := tokenizer.Token()
+	parent := ""
+	if len(rw.openElements) > 0 {
+		parent = rw.openElements[len(rw.openElements)-1]
+	}
+	rw.rawElement = ""
+	if opening && !voidElements[token.Data] {
+		rw.openElements = append(rw.openElements, token.Data)
+		switch token.Data {
+		case "template":
+			rw.templates++
+		case "style", "noscript":
+			rw.rawElement = token.Data
+		case "script":
+			rw.rawElement = token.Data
+			rw.scriptType = ""
+			for _, attr := range token.Attr {
+				if attr.Key == "type" {
+					rw.scriptType = strings.ToLower(strings.TrimSpace(attr.Val))
+				}
+			}
+		}
+	}
+
+	depth := rw.depth()
+	if depth > config.MaxRewriteDepth {
+		return token.Data, nil
+	}
+
+	modified := false
+	attrs := token.Attr[:0]
+	for _, attr := range token.Attr {
+		var err error
+		val := attr.Val
+		switch attr.Key {
+		case "href":
+			if parent == "svg" { // hrefs are different in SVGs
+				break
+			}
+			val, err = formatURI(attr.Val, rw.BaseURL, rw.Link)
+		case "src", "poster":
+			val, err = formatURI(attr.Val, rw.BaseURL, rw.Link)
+		case "srcset":
+			val = rw.srcset(attr.Val)
+		case "style":
+			val = modifyCSS(attr.Val, rw.BaseURL, rw.Link)
+		case "srcdoc":
+			if token.Data == "iframe" && depth < config.MaxRewriteDepth { // Srcdoc attributes hold an entire HTML document
+				val, err = rw.nested(attr.Val)
+			}
+		case "integrity":
+			if config.StripIntegrityAttributes { // Remove integrity attributes, because we modify CSS
+				modified = true
+				continue
+			}
+		case "data-bypass-modified":
+			continue // We add this back ourselves if anything was modified
+		}
+		if err != nil {
+			slog.Debug("couldn't rewrite an attribute", "attribute", attr.Key, "error", err)
+			val = attr.Val
+		}
+		if val != attr.Val {
+			modified = true
+		}
+		attr.Val = val
+		attrs = append(attrs, attr)
+	}
+	if !modified {
+		return token.Data, nil
+	}
+	token.Attr = append(attrs, html.Attribute{Key: "data-bypass-modified", Val: "true"})
+	return token.Data, []byte(token.String())
+}
+
+func (rw *htmlRewriter) endTag(tokenizer *html.Tokenizer) { // Close the most recently opened element that matches an end tag
+	name, _ := tokenizer.TagName()
+	for i := len(rw.openElements) - 1; i >= 0; i-- {
+		if rw.openElements[i] == string(name) {
+			rw.openElements = rw.openElements[:i]
+			break
+		}
+	}
+	if string(name) == "template" && rw.templates > 0 {
+		rw.templates--
+	}
+	rw.rawElement = ""
+}
+
+func (rw *htmlRewriter) text(raw []byte) []byte { // Rewrite the contents of raw text elements, returning nil if nothing changed
+	depth := rw.depth()
+	if depth > config.MaxRewriteDepth {
+		return nil
+	}
+	switch rw.rawElement {
+	case "style":
+		return []byte(modifyCSS(string(raw), rw.BaseURL, rw.Link))
+	case "noscript":
+		if depth >= config.MaxRewriteDepth { // Noscript content is parsed as raw text when scripting is enabled, so it's another nested document
+			return nil
+		}
+		rewritten, err := rw.nested(string(raw))
+		if err != nil {
+			slog.Debug("couldn't rewrite a noscript element", "error", err)
+			return nil
+		}
+		return []byte(rewritten)
+	case "script":
+		if !config.ModifyJS {
+			return nil
+		}
+		var rewritten string
+		var err error
+		switch rw.scriptType {
+		case "", "module", "text/javascript", "application/javascript":
+			rewritten, err = modifyJS(string(raw), rw.BaseURL, rw.Link)
+		case "importmap":
+			rewritten, err = modifyImportMap(string(raw), rw.BaseURL, rw.Link)
+		default: // Templates and data blocks aren't scripts at all
+			return nil
+		}
+		if err != nil {
+			slog.Debug("couldn't rewrite a script", "error", err)
+			return nil
+		}
+		return []byte(rewritten)
+	}
+	return nil
+}
+
+func (rw *htmlRewriter) nested(doc string) (string, error) { // Rewrite a document nested within the current one
+	var buf bytes.Buffer
+	nested := &htmlRewriter{BaseURL: rw.BaseURL, Link: rw.Link, Depth: rw.depth() + 1}
+	err := nested.Rewrite(&buf, strings.NewReader(doc))
+	return buf.String(), err
+}
+
+func (rw *htmlRewriter) depth() int { // Template content is a nested document, so open templates count towards the depth limit
+	return rw.Depth + rw.templates
+}
+
+func (rw *htmlRewriter) srcset(val string) string { // Rewrite every URL in a srcset attribute
+	replacedurl := val
+	for _, src := range srcset.Parse(val) {
+		formattedurl, err := formatURI(src.URL, rw.BaseURL, rw.Link)
+		if err == nil {
+			replacedurl = strings.Replace(replacedurl, src.URL, formattedurl, 1)
+		}
+	}
+	return replacedurl
+}
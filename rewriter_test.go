@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/lukasbob/srcset"
+)
+
+const testBaseURL = "https://example.com/dir/page.html"
+
+var testLink = &linkBase{ExternalURL: "http://proxy.test"}
+
+func testProxied(target string) string { // The URL that the query codec gives target, without any tokens
+	return "http://proxy.test/p/?" + url.Values{"u": {base64.StdEncoding.EncodeToString([]byte(target))}}.Encode()
+}
+
+func rewriteHTML(t testing.TB, doc string) string {
+	var sb strings.Builder
+	rw := &htmlRewriter{BaseURL: testBaseURL, Link: testLink}
+	err := rw.Rewrite(&sb, strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sb.String()
+}
+
+func TestRewriteHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		contains []string // Strings that have to be in the rewritten document
+		excludes []string // Strings that mustn't be
+	}{
+		{
+			name:     "relative href",
+			doc:      `<a href="other.html">Other</a>`,
+			contains: []string{`href="` + testProxied("https://example.com/dir/other.html") + `"`, `data-bypass-modified="true"`},
+		},
+		{
+			name:     "absolute src",
+			doc:      `<img src="https://cdn.example.net/a.png">`,
+			contains: []string{`src="` + testProxied("https://cdn.example.net/a.png") + `"`},
+		},
+		{
+			name:     "srcset",
+			doc:      `<img srcset="a.png 1x, /b.png 2x">`,
+			contains: []string{testProxied("https://example.com/dir/a.png") + " 1x", testProxied("https://example.com/b.png") + " 2x"},
+		},
+		{
+			name:     "style attribute",
+			doc:      `<div style="background: url('bg.png')"></div>`,
+			contains: []string{testProxied("https://example.com/dir/bg.png")},
+		},
+		{
+			name:     "integrity is stripped",
+			doc:      `<script src="a.js" integrity="sha384-abc"></script>`,
+			excludes: []string{"integrity"},
+		},
+		{
+			name:     "fragment links are left alone",
+			doc:      `<a href="#top">Top</a>`,
+			contains: []string{`<a href="#top">Top</a>`},
+			excludes: []string{"data-bypass-modified"},
+		},
+		{
+			name:     "svg hrefs are left alone",
+			doc:      `<svg><use href="#icon"></use></svg>`,
+			contains: []string{`<use href="#icon">`},
+		},
+		{
+			name:     "srcdoc",
+			doc:      `<iframe srcdoc="<img src=&quot;inner.png&quot;>"></iframe>`,
+			contains: []string{testProxied("https://example.com/dir/inner.png")},
+			excludes: []string{`src=&#34;inner.png`},
+		},
+		{
+			name:     "noscript",
+			doc:      `<noscript><img src="fallback.png"></noscript>`,
+			contains: []string{`<noscript><img src="` + testProxied("https://example.com/dir/fallback.png") + `"`},
+		},
+		{
+			name:     "template",
+			doc:      `<template><a href="/in-template">x</a></template>`,
+			contains: []string{`href="` + testProxied("https://example.com/in-template") + `"`},
+		},
+		{
+			name:     "inline module script",
+			doc:      `<script type="module">import x from "./mod.js"; import y from "bare";</script>`,
+			contains: []string{`from "` + testProxied("https://example.com/dir/mod.js") + `"`, `from "bare"`},
+		},
+		{
+			name:     "inline classic script",
+			doc:      `<script>new Worker("worker.js")</script>`,
+			contains: []string{`new Worker("` + testProxied("https://example.com/dir/worker.js") + `")`},
+		},
+		{
+			name:     "data blocks aren't scripts",
+			doc:      `<script type="text/template">import x from "./mod.js"</script>`,
+			contains: []string{`import x from "./mod.js"`},
+		},
+		{
+			name:     "import map",
+			doc:      `<script type="importmap">{"imports": {"lib": "/lib.js"}}</script>`,
+			contains: []string{`"lib":"` + testProxied("https://example.com/lib.js") + `"`},
+		},
+		{
+			name:     "style element",
+			doc:      `<style>body { background: url(bg.png) }</style>`,
+			contains: []string{testProxied("https://example.com/dir/bg.png")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rewritten := rewriteHTML(t, test.doc)
+			for _, s := range test.contains {
+				if !strings.Contains(rewritten, s) {
+					t.Errorf("rewritten document doesn't contain %q:\n%s", s, rewritten)
+				}
+			}
+			for _, s := range test.excludes {
+				if strings.Contains(rewritten, s) {
+					t.Errorf("rewritten document contains %q:\n%s", s, rewritten)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteHTMLKeepsMarkup(t *testing.T) { // Anything without a URL in it comes out exactly as it went in
+	doc := "<!DOCTYPE html>\n<HTML><Head><TITLE>T &amp; T</TITLE></Head>\n<body class=x>\n<!-- a comment -->\n<P>Text<br/></P></body></HTML>"
+	rewritten := rewriteHTML(t, doc)
+	if rewritten != doc {
+		t.Errorf("got %q, want %q", rewritten, doc)
+	}
+}
+
+func TestRewriteHTMLDepth(t *testing.T) {
+	defer func(depth int) { config.MaxRewriteDepth = depth }(config.MaxRewriteDepth)
+	config.MaxRewriteDepth = 1
+
+	nested := `<template><template><a href="deep.html">x</a></template><a href="shallow.html">x</a></template>`
+	rewritten := rewriteHTML(t, nested)
+	if !strings.Contains(rewritten, testProxied("https://example.com/dir/shallow.html")) {
+		t.Errorf("a template within the depth limit wasn't rewritten:\n%s", rewritten)
+	}
+	if !strings.Contains(rewritten, `href="deep.html"`) {
+		t.Errorf("a template past the depth limit was rewritten:\n%s", rewritten)
+	}
+
+	srcdoc := `<iframe srcdoc="<iframe srcdoc='<a href=deep.html>x</a>'></iframe>"></iframe>`
+	rewritten = rewriteHTML(t, srcdoc)
+	if strings.Contains(rewritten, base64.StdEncoding.EncodeToString([]byte("https://example.com/dir/deep.html"))) {
+		t.Errorf("a srcdoc past the depth limit was rewritten:\n%s", rewritten)
+	}
+}
+
+func TestRewriteHTMLInject(t *testing.T) {
+	inject := []byte(`<script data-bypass-modified="true"></script>`)
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`<html><head><title>x</title></head></html>`, `<html><head><script data-bypass-modified="true"></script><title>x</title></head></html>`},
+		{`<p>No head</p>`, `<script data-bypass-modified="true"></script><p>No head</p>`},
+	}
+	for _, test := range tests {
+		var sb strings.Builder
+		rw := &htmlRewriter{BaseURL: testBaseURL, Link: testLink, Inject: inject}
+		err := rw.Rewrite(&sb, strings.NewReader(test.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sb.String() != test.want {
+			t.Errorf("got %q, want %q", sb.String(), test.want)
+		}
+	}
+}
+
+func benchmarkPage(links int) string { // Make a page that looks roughly like a real one, with links, images, styles and scripts
+	var sb strings.Builder
+	sb.WriteString(`<!DOCTYPE html><html><head><title>Benchmark</title><link rel="stylesheet" href="/style.css"><style>body { background: url(bg.png) }</style></head><body>`)
+	for i := 0; i < links; i++ {
+		fmt.Fprintf(&sb, `<div class="item"><a href="/item/%d">Item %d</a><img src="thumb-%d.png" srcset="thumb-%d.png 1x, thumb-%d@2x.png 2x" alt="">`, i, i, i, i, i)
+		sb.WriteString(`<p>Some text that doesn't have any URLs in it, which is most of a page.</p></div>`)
+	}
+	sb.WriteString(`<script type="module">import app from "./app.js"; app();</script></body></html>`)
+	return sb.String()
+}
+
+func benchmarkNestedPage() string { // Make a page with a copy of benchmarkPage in each kind of nested document
+	page := benchmarkPage(10)
+	return `<iframe srcdoc="` + strings.Replace(page, `"`, "&quot;", -1) + `"></iframe><template>` + page + `</template><noscript>` + page + `</noscript>`
+}
+
+func benchmarkRewriteHTML(b *testing.B, doc string) {
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rw := &htmlRewriter{BaseURL: testBaseURL, Link: testLink}
+		err := rw.Rewrite(ioutil.Discard, strings.NewReader(doc))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRewriteHTMLSmall(b *testing.B) {
+	benchmarkRewriteHTML(b, benchmarkPage(10))
+}
+
+func BenchmarkRewriteHTMLLarge(b *testing.B) {
+	benchmarkRewriteHTML(b, benchmarkPage(1000))
+}
+
+func BenchmarkRewriteHTMLNested(b *testing.B) {
+	benchmarkRewriteHTML(b, benchmarkNestedPage())
+}
+
+// The goquery benchmarks are a baseline for the ones above. They rewrite the same pages the way that proxyHandler did before
+// htmlRewriter, by parsing the whole page into a document, making a pass over it for every kind of attribute, and rendering it again.
+
+func benchmarkGoquery(b *testing.B, doc string) {
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		document, err := goquery.NewDocumentFromReader(strings.NewReader(doc))
+		if err != nil {
+			b.Fatal(err)
+		}
+		goqueryModifyDocument(document.Selection, testBaseURL, 0)
+		parsedhtml, err := goquery.OuterHtml(document.Selection)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.WriteString(ioutil.Discard, parsedhtml)
+	}
+}
+
+func BenchmarkGoquerySmall(b *testing.B) {
+	benchmarkGoquery(b, benchmarkPage(10))
+}
+
+func BenchmarkGoqueryLarge(b *testing.B) {
+	benchmarkGoquery(b, benchmarkPage(1000))
+}
+
+func BenchmarkGoqueryNested(b *testing.B) {
+	benchmarkGoquery(b, benchmarkNestedPage())
+}
+
+func goqueryModifyDocument(root *goquery.Selection, baseURL string, depth int) { // Modify every URL in root like htmlRewriter does, with a goquery pass for each kind of attribute
+	find := func(selector string) *goquery.Selection { // Find only the elements that belong to root, and not to a nested template's content
+		return root.Find(selector).FilterFunction(func(i int, s *goquery.Selection) bool {
+			for parent := s.Nodes[0].Parent; parent != nil && parent != root.Nodes[0]; parent = parent.Parent {
+				if parent.Type == html.ElementNode && parent.Data == "template" {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	setURL := func(s *goquery.Selection, attr string) {
+		origlink, exists := s.Attr(attr)
+		if exists {
+			formattedurl, err := formatURI(origlink, baseURL, testLink)
+			if err == nil {
+				s.SetAttr(attr, formattedurl)
+				s.SetAttr("data-bypass-modified", "true")
+			}
+		}
+	}
+	setRawText := func(s *goquery.Selection, text string) { // Replace the contents of raw text elements without escaping the text like SetText does
+		for _, node := range s.Nodes {
+			for node.FirstChild != nil {
+				node.RemoveChild(node.FirstChild)
+			}
+			node.AppendChild(&html.Node{Type: html.RawNode, Data: text})
+		}
+	}
+
+	find("*[href]").Each(func(i int, s *goquery.Selection) {
+		if len(s.Parent().Nodes) > 0 && s.Parent().Nodes[0].Type == html.ElementNode && s.Parent().Nodes[0].Data == "svg" {
+			return
+		}
+		setURL(s, "href")
+	})
+	find("*[src]").Each(func(i int, s *goquery.Selection) { setURL(s, "src") })
+	find("*[poster]").Each(func(i int, s *goquery.Selection) { setURL(s, "poster") })
+	find("*[srcset]").Each(func(i int, s *goquery.Selection) {
+		origlink, _ := s.Attr("srcset")
+		replacedurl := origlink
+		for _, image := range srcset.Parse(origlink) {
+			formattedurl, err := formatURI(image.URL, baseURL, testLink)
+			if err == nil {
+				replacedurl = strings.Replace(replacedurl, image.URL, formattedurl, 1)
+			}
+		}
+		s.SetAttr("srcset", replacedurl)
+		s.SetAttr("data-bypass-modified", "true")
+	})
+	find("*[style]").Each(func(i int, s *goquery.Selection) {
+		style, _ := s.Attr("style")
+		s.SetAttr("style", modifyCSS(style, baseURL, testLink))
+		s.SetAttr("data-bypass-modified", "true")
+	})
+	find("style").Each(func(i int, s *goquery.Selection) {
+		setRawText(s, modifyCSS(s.Text(), baseURL, testLink))
+	})
+	if config.StripIntegrityAttributes {
+		find("*[integrity]").Each(func(i int, s *goquery.Selection) {
+			s.RemoveAttr("integrity")
+		})
+	}
+
+	if depth >= config.MaxRewriteDepth {
+		return
+	}
+	find("template").Each(func(i int, s *goquery.Selection) {
+		goqueryModifyDocument(s, baseURL, depth+1)
+	})
+	find("noscript").Each(func(i int, s *goquery.Selection) {
+		nodes, err := html.ParseFragment(strings.NewReader(s.Text()), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+		if err != nil {
+			return
+		}
+		container := &html.Node{Type: html.DocumentNode}
+		for _, node := range nodes {
+			container.AppendChild(node)
+		}
+		goqueryModifyDocument(goquery.NewDocumentFromNode(container).Selection, baseURL, depth+1)
+		var buf bytes.Buffer
+		for node := container.FirstChild; node != nil; node = node.NextSibling {
+			html.Render(&buf, node)
+		}
+		setRawText(s, buf.String())
+	})
+	find("iframe[srcdoc]").Each(func(i int, s *goquery.Selection) {
+		srcdoc, _ := s.Attr("srcdoc")
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(srcdoc))
+		if err != nil {
+			return
+		}
+		goqueryModifyDocument(doc.Selection, baseURL, depth+1)
+		parsedhtml, err := goquery.OuterHtml(doc.Selection)
+		if err != nil {
+			return
+		}
+		s.SetAttr("srcdoc", parsedhtml)
+		s.SetAttr("data-bypass-modified", "true")
+	})
+}
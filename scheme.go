@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+type schemePolicy int // The schemePolicy type says what happens to URLs with a certain scheme
+
+const (
+	schemePass       schemePolicy = iota // Leave the URL as it is
+	schemeProxy                          // Send the URL through the proxy
+	schemeNeutralize                     // Replace the URL with one that does nothing
+	schemeBlock                          // Send the URL to the proxy, which refuses to fetch it
+)
+
+const neutralizedURL = "about:blank" // What neutralized URLs are replaced with
+
+var schemePolicyNames = map[string]schemePolicy{
+	"pass": schemePass, "proxy": schemeProxy, "neutralize": schemeNeutralize, "block": schemeBlock,
+}
+
+type schemePolicies map[string]schemePolicy // The schemePolicies type is a flag value that holds comma separated scheme=policy pairs, where the scheme * is every scheme not listed
+
+func defaultSchemePolicies() schemePolicies { // Policies that keep pages working like they would without the proxy
+	return schemePolicies{
+		"http": schemeProxy, "https": schemeProxy,
+		"data": schemePass, "blob": schemePass, "about": schemePass, "javascript": schemePass,
+		"mailto": schemePass, "tel": schemePass, "sms": schemePass,
+		"ws": schemePass, "wss": schemePass, // The proxy can't carry WebSockets
+		"*": schemePass, // Links to other schemes (eg. ftp: or an app's own) usually open something outside of the browser, which the proxy couldn't fetch anyway
+	}
+}
+
+func (policies *schemePolicies) String() string {
+	var pairs []string
+	for scheme, policy := range *policies {
+		for name, namedPolicy := range schemePolicyNames {
+			if namedPolicy == policy {
+				pairs = append(pairs, scheme+"="+name)
+			}
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (policies *schemePolicies) Set(value string) error { // Set overrides the policies of the schemes that are listed, and keeps the rest
+	if *policies == nil {
+		*policies = defaultSchemePolicies()
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		split := strings.SplitN(pair, "=", 2)
+		if len(split) != 2 {
+			return errors.New("scheme: " + pair + " should look like scheme=policy")
+		}
+		policy, ok := schemePolicyNames[strings.ToLower(strings.TrimSpace(split[1]))]
+		if !ok {
+			return errors.New("scheme: policy for " + split[0] + " must be one of pass, proxy, neutralize or block")
+		}
+		(*policies)[strings.ToLower(strings.TrimSpace(split[0]))] = policy
+	}
+	return nil
+}
+
+func schemePolicyFor(scheme string) schemePolicy { // Get the policy for URLs with a scheme
+	if scheme == "" { // Typed in without a scheme, which is assumed to be http
+		return schemeProxy
+	}
+	if policy, ok := config.SchemePolicies[strings.ToLower(scheme)]; ok {
+		return policy
+	}
+	return config.SchemePolicies["*"]
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSchemePolicies(t *testing.T) {
+	defer func(policies schemePolicies) { config.SchemePolicies = policies }(config.SchemePolicies)
+	tests := []struct {
+		schemes string // Value of the schemes flag, on top of the defaults
+		rawurl  string
+		want    string
+	}{
+		{"", "https://example.com/a", testProxied("https://example.com/a")},
+		{"", "//example.com/a", testProxied("https://example.com/a")},
+		{"", "mailto:someone@example.com", "mailto:someone@example.com"},
+		{"", "javascript:void(0)", "javascript:void(0)"},
+		{"", "data:text/plain,hi", "data:text/plain,hi"},
+		{"", "ftp://example.com/file.txt", "ftp://example.com/file.txt"}, // Schemes without a policy are left alone
+		{"", "steam://run/440", "steam://run/440"},
+		{"javascript=neutralize", "javascript:alert(1)", neutralizedURL},
+		{"ftp=block", "ftp://example.com/file.txt", testProxied("ftp://example.com/file.txt")}, // Blocked URLs go to the proxy, which says why they don't work
+		{"*=neutralize", "steam://run/440", neutralizedURL},
+		{"*=neutralize", "mailto:someone@example.com", "mailto:someone@example.com"},
+	}
+	for _, test := range tests {
+		config.SchemePolicies = defaultSchemePolicies()
+		err := config.SchemePolicies.Set(test.schemes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := formatURI(test.rawurl, "https://example.com/", testLink)
+		if err != nil {
+			t.Errorf("%s with %q: %v", test.rawurl, test.schemes, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s with %q: got %q, want %q", test.rawurl, test.schemes, got, test.want)
+		}
+	}
+}
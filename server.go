@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+func newServer(handler http.Handler) *http.Server { // Make the server that Bypass is served with from the server flags
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.ServerIdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
+
+type listenGroup struct { // The listenGroup type is a server, and the addresses that it's served on
+	Server *http.Server
+	Addrs  []string
+	Name   string // What the server is for, for logs
+}
+
+func serve(groups ...listenGroup) error { // Serve every group on its addresses until we get SIGINT or SIGTERM, then let requests in progress finish before returning
+	type groupListener struct {
+		net.Listener
+		Group listenGroup
+	}
+	var listeners []groupListener
+	for _, group := range groups {
+		for _, addr := range group.Addrs { // Listen on everything up front, so that a bad address stops Bypass before it serves anything
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				for _, opened := range listeners {
+					opened.Close()
+				}
+				return err
+			}
+			listeners = append(listeners, groupListener{listener, group})
+		}
+	}
+
+	serveErrs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		slog.Info("Bypass is listening", "server", listener.Group.Name, "addr", listener.Addr().String())
+		go func(listener groupListener) {
+			if config.EnableTLS {
+				serveErrs <- listener.Group.Server.ServeTLS(listener.Listener, config.TLSCertPath, config.TLSKeyPath)
+			} else {
+				serveErrs <- listener.Group.Server.Serve(listener.Listener)
+			}
+		}(listener)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var err error
+	running := len(listeners) // Number of Serve calls that haven't returned yet
+	select {
+	case sig := <-signals:
+		slog.Info("shutting down, once requests in progress finish", "signal", sig.String(), "drain_timeout", config.DrainTimeout)
+	case err = <-serveErrs: // One of the listeners failed, so stop the rest too
+		running--
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	var shutdowns sync.WaitGroup
+	for _, group := range groups { // Every server drains at the same time, within the same deadline
+		shutdowns.Add(1)
+		go func(group listenGroup) {
+			defer shutdowns.Done()
+			if shutdownErr := group.Server.Shutdown(ctx); shutdownErr != nil {
+				slog.Warn("requests were still in progress after the drain timeout, so they were cut off", "server", group.Name, "drain_timeout", config.DrainTimeout)
+				group.Server.Close()
+			}
+		}(group)
+	}
+	shutdowns.Wait()
+	for ; running > 0; running-- { // Every other Serve returns once the server is shut down
+		if serveErr := <-serveErrs; err == nil && !errors.Is(serveErr, http.ErrServerClosed) {
+			err = serveErr
+		}
+	}
+	return err
+}
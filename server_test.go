@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeReturnsWhenAListenerFails(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.EnableTLS, config.DrainTimeout = true, time.Second
+	config.TLSCertPath, config.TLSKeyPath = filepath.Join(t.TempDir(), "missing.crt"), filepath.Join(t.TempDir(), "missing.key")
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(
+			listenGroup{Server: newServer(http.NotFoundHandler()), Addrs: []string{"127.0.0.1:0", "127.0.0.1:0"}, Name: "proxy"},
+			listenGroup{Server: newServer(http.NotFoundHandler()), Addrs: []string{"127.0.0.1:0"}, Name: "admin"},
+		)
+	}()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("serve returned no error without a certificate")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve didn't return after a listener failed")
+	}
+}
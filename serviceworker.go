@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const serviceWorkerScript = "bypass-sw.js" // Name of the service worker script in config.PublicDir
+
+var serviceWorkerCache []byte // Service worker script, read once when Bypass starts if config.CacheStatic is set
+
+func serviceWorkerHandler(resWriter http.ResponseWriter, reqHTTP *http.Request) *reqError { // Serve Bypass' service worker, allowing it to control every page on the proxy
+	externalURL, err := requestExternalURL(reqHTTP)
+	if err != nil {
+		return &reqError{err, "Bypass isn't served from this host.", 400}
+	}
+	script := serviceWorkerCache
+	if script == nil {
+		script, err = ioutil.ReadFile(config.PublicDir + "/" + serviceWorkerScript)
+		if err != nil {
+			return &reqError{err, "Couldn't read service worker script.", 404}
+		}
+	}
+
+	resWriter.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	resWriter.Header().Set("Service-Worker-Allowed", serviceWorkerScope(externalURL))
+	resWriter.Header().Set("Cache-Control", "no-cache") // Browsers should always check for an updated worker
+	_, err = resWriter.Write(script)
+	if err != nil {
+		return &reqError{err, "Couldn't write content to response.", 500}
+	}
+	return nil
+}
+
+func serviceWorkerScope(proxyURL string) string { // Get the scope that Bypass' service worker controls, which is everything under the proxy's external URL
+	return externalPath(proxyURL)
+}
+
+func serviceWorkerSnippet(proxyURL string) []byte { // Make a script element that installs Bypass' service worker, and stops proxied pages from installing their own
+	scriptURL, _ := json.Marshal(serviceWorkerScope(proxyURL) + serviceWorkerScript) // Relative to the page's origin, which may be an origin subdomain
+	scope, _ := json.Marshal(serviceWorkerScope(proxyURL))
+
+	var sb strings.Builder
+	sb.WriteString(`<script data-bypass-modified="true">(function(){if(!("serviceWorker" in navigator))return;var sw=navigator.serviceWorker,register=sw.register.bind(sw);`)
+	if config.BlockOriginServiceWorkers {
+		sb.WriteString(`sw.register=function(){return Promise.reject(new DOMException("Service workers are disabled by Bypass.","SecurityError"))};`)
+	}
+	sb.WriteString(`register(` + string(scriptURL) + `,{scope:` + string(scope) + `})})();</script>`)
+	return []byte(sb.String())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServiceWorkerAllowed(t *testing.T) {
+	saved := config
+	savedCache := serviceWorkerCache
+	t.Cleanup(func() { config, serviceWorkerCache = saved, savedCache })
+	config.ExternalURL, config.ExternalURLFromRequest = "http://bypass.example/tools/bypass", true
+	config.ExternalHosts = stringList{"bypass.example", "bypass.internal"}
+	serviceWorkerCache = []byte("self.addEventListener('fetch', function() {})")
+
+	tests := []struct {
+		url     string
+		status  int
+		allowed string // Service-Worker-Allowed header, if the script is served
+	}{
+		{"http://bypass.example/bypass-sw.js", 200, "/tools/bypass/"},
+		{"http://bypass.internal/bypass-sw.js", 200, "/tools/bypass/"},
+		{"http://evil.example/bypass-sw.js", 400, ""},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		reqHandler(serviceWorkerHandler).ServeHTTP(recorder, httptest.NewRequest("GET", test.url, nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.url, recorder.Code, test.status)
+		}
+		if allowed := recorder.Header().Get("Service-Worker-Allowed"); allowed != test.allowed {
+			t.Errorf("%s: Service-Worker-Allowed is %q, want %q", test.url, allowed, test.allowed)
+		}
+	}
+}
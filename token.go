@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sessionCookie = "bypass_session" // Name of the cookie that holds the ID of the session tokens are bound to
+
+type tokenKeyring struct { // The tokenKeyring type holds the keys used to encrypt and decrypt URL tokens
+	Active    byte                 // ID of the key that new tokens are encrypted with
+	Keys      map[byte]cipher.AEAD // Every key that tokens can be decrypted with, by ID
+	NonceKeys map[byte][]byte      // Keys that nonces are derived with, by the ID of the key they're derived from
+}
+
+var tokenKeys *tokenKeyring // Keys for URL tokens, nil if URLs aren't encrypted
+
+func loadTokenKeys(path string) (*tokenKeyring, error) { // Load a key file, where each line is a key ID (1-255) and a base64 encoded AES key, and the first key is the active one
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keyring := &tokenKeyring{Keys: make(map[byte]cipher.AEAD), NonceKeys: make(map[byte][]byte)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, errors.New("token: line " + strconv.Itoa(line) + " should be a key ID followed by a key")
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil || id == 0 {
+			return nil, errors.New("token: line " + strconv.Itoa(line) + " has an invalid key ID, it must be between 1 and 255")
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, errors.New("token: line " + strconv.Itoa(line) + " has a key that isn't valid base64")
+		}
+		block, err := aes.NewCipher(key) // This also checks that the key is 16, 24 or 32 bytes long
+		if err != nil {
+			return nil, errors.New("token: line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if keyring.Keys[byte(id)] != nil {
+			return nil, errors.New("token: key ID " + fields[0] + " is used more than once")
+		}
+		if len(keyring.Keys) == 0 {
+			keyring.Active = byte(id)
+		}
+		keyring.Keys[byte(id)] = aead
+		nonceKey := hmac.New(sha256.New, key) // A separate key, so that the AES key is only ever used for AES
+		nonceKey.Write([]byte("bypass token nonce"))
+		keyring.NonceKeys[byte(id)] = nonceKey.Sum(nil)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keyring.Keys) == 0 {
+		return nil, errors.New("token: no keys in " + path)
+	}
+	return keyring, nil
+}
+
+func (keyring *tokenKeyring) Seal(target string, session string) (string, error) { // Encrypt a URL into a URL-safe token that can only be read by this proxy, and only for the given session
+	aead := keyring.Keys[keyring.Active]
+	plaintext := make([]byte, 8, 8+len(target))
+	if config.TokenTTL > 0 {
+		binary.BigEndian.PutUint64(plaintext, uint64(tokenExpiry(time.Now(), config.TokenTTL).Unix()))
+	}
+	plaintext = append(plaintext, target...)
+
+	// The nonce is derived from everything that's sealed, so that the same URL always gets the same token (otherwise modules are
+	// evaluated once for each token they're imported by, import map keys stop matching, and caches never hit). Nonces are only ever
+	// reused for identical tokens, which gives away nothing but that they're identical.
+	mac := hmac.New(sha256.New, keyring.NonceKeys[keyring.Active])
+	additionalData := tokenAdditionalData(keyring.Active, session)
+	binary.Write(mac, binary.BigEndian, uint64(len(additionalData)))
+	mac.Write(additionalData)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	token := append([]byte{keyring.Active}, nonce...)
+	token = aead.Seal(token, nonce, plaintext, additionalData)
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func tokenExpiry(now time.Time, ttl time.Duration) time.Time { // Get when a token made now expires, rounded up so that tokens for the same URL stay the same for a quarter of the TTL
+	bucket := (ttl / 4).Truncate(time.Second)
+	if bucket < time.Second {
+		bucket = time.Second
+	}
+	expiry := now.Add(ttl)
+	if rounded := expiry.Truncate(bucket); rounded.Before(expiry) {
+		expiry = rounded.Add(bucket)
+	}
+	return expiry
+}
+
+func (keyring *tokenKeyring) Open(token string, session string) (string, error) { // Decrypt a token made by Seal, checking that it hasn't expired
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", errors.New("token: not valid base64")
+	}
+	if len(raw) < 1 {
+		return "", errors.New("token: too short")
+	}
+	aead := keyring.Keys[raw[0]]
+	if aead == nil {
+		return "", errors.New("token: encrypted with an unknown key")
+	}
+	if len(raw) < 1+aead.NonceSize()+aead.Overhead()+8 {
+		return "", errors.New("token: too short")
+	}
+
+	nonce := raw[1 : 1+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, raw[1+aead.NonceSize():], tokenAdditionalData(raw[0], session))
+	if err != nil {
+		return "", errors.New("token: tampered with, or bound to another session")
+	}
+	expiry := binary.BigEndian.Uint64(plaintext[:8])
+	if expiry != 0 && time.Now().Unix() > int64(expiry) {
+		return "", errors.New("token: expired")
+	}
+	return string(plaintext[8:]), nil
+}
+
+func tokenAdditionalData(keyID byte, session string) []byte { // Tokens are authenticated along with their key ID, and the session they're bound to
+	return append([]byte{keyID}, session...)
+}
+
+func tokenSession(reqHTTP *http.Request) string { // Get the session that the client's tokens are bound to, if it has one
+	if !config.TokenBindSession {
+		return ""
+	}
+	cookie, err := reqHTTP.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func startTokenSession(resWriter http.ResponseWriter, proxyURL string) (string, error) { // Start a new session for a client, which tokens made for it will be bound to
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	session := base64.RawURLEncoding.EncodeToString(id)
+	cookie := &http.Cookie{Name: sessionCookie, Value: session, Path: externalPath(proxyURL), HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if externalURL, err := url.Parse(proxyURL); err == nil && config.IsolateOrigins {
+		cookie.Domain = externalURL.Hostname() // Origin subdomains need the session too
+	}
+	http.SetCookie(resWriter, cookie)
+	return session, nil
+}
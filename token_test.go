@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testKeyring(t *testing.T) *tokenKeyring {
+	path := filepath.Join(t.TempDir(), "keys")
+	err := ioutil.WriteFile(path, []byte("# Test keys\n2 "+base64.StdEncoding.EncodeToString(make([]byte, 32))+"\n1 "+base64.StdEncoding.EncodeToString(make([]byte, 16))+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := loadTokenKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestTokenSealOpen(t *testing.T) {
+	keyring := testKeyring(t)
+	token, err := keyring.Seal("https://example.com/a?b=c", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := keyring.Open(token, "session"); err != nil || target != "https://example.com/a?b=c" {
+		t.Errorf("opened %q (%v), want the sealed URL", target, err)
+	}
+	if _, err := keyring.Open(token, "another session"); err == nil {
+		t.Error("a token opened for another session")
+	}
+	tampered := []byte(token)
+	tampered[len(tampered)-3] ^= 1
+	if _, err := keyring.Open(string(tampered), "session"); err == nil {
+		t.Error("a tampered token opened")
+	}
+}
+
+func TestTokenSealIsDeterministic(t *testing.T) {
+	defer func(ttl time.Duration) { config.TokenTTL = ttl }(config.TokenTTL)
+	config.TokenTTL = time.Hour
+
+	keyring := testKeyring(t)
+	seal := func(target string, session string) string {
+		token, err := keyring.Seal(target, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	token := seal("https://example.com/module.js", "session")
+	if seal("https://example.com/module.js", "session") != token {
+		t.Error("the same URL got different tokens")
+	}
+	if seal("https://example.com/other.js", "session") == token {
+		t.Error("different URLs got the same token")
+	}
+	if seal("https://example.com/module.js", "another session") == token {
+		t.Error("the same URL got the same token in different sessions")
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	now := time.Unix(1000000, 500)
+	for _, ttl := range []time.Duration{time.Nanosecond, 10 * time.Second, time.Hour, 24 * time.Hour} {
+		expiry := tokenExpiry(now, ttl)
+		if expiry.Before(now.Add(ttl)) {
+			t.Errorf("%v: expires at %v, before the TTL is up", ttl, expiry)
+		}
+		if max := now.Add(ttl + ttl/4 + time.Second); expiry.After(max) {
+			t.Errorf("%v: expires at %v, after %v", ttl, expiry, max)
+		}
+		if tokenExpiry(now.Add(time.Nanosecond), ttl) != expiry && ttl >= 4*time.Second {
+			t.Errorf("%v: expiry changed from one moment to the next", ttl)
+		}
+	}
+}
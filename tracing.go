@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/pietroglyph/bypass-webproxy") // Makes every span, and does nothing until setupTracing sets up an exporter
+
+var tracePropagator = propagation.TraceContext{} // W3C traceparent and tracestate headers
+
+func setupTracing() (func(context.Context) error, error) { // Set up exporting spans from the trace flags, returning a function that flushes them when Bypass shuts down
+	if config.TraceEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.TraceEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "bypass"))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func withTracing(handler http.Handler) http.Handler { // Trace every request, continuing the client's trace if trace-extract trusts it
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		ctx := reqHTTP.Context()
+		if config.TraceExtract == "all" || (config.TraceExtract == "trusted" && isTrustedProxy(reqHTTP.RemoteAddr)) {
+			ctx = tracePropagator.Extract(ctx, propagation.HeaderCarrier(reqHTTP.Header))
+		}
+		ctx, span := tracer.Start(ctx, reqHTTP.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", reqHTTP.Method),
+			attribute.String("client.address", clientIP(reqHTTP)),
+		))
+		defer span.End()
+
+		writer := &loggingResponseWriter{ResponseWriter: resWriter}
+		handler.ServeHTTP(writer, reqHTTP.WithContext(ctx))
+
+		record := requestRecord(reqHTTP)
+		status := writer.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetName(reqHTTP.Method + " " + record.Route)
+		span.SetAttributes(attribute.String("http.route", record.Route), attribute.Int("http.response.status_code", status), attribute.String("bypass.request_id", record.ID))
+		if record.Target != "" {
+			span.SetAttributes(attribute.String("bypass.target", redactURL(record.Target)))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+type stageTracer struct { // The stageTracer type traces the stages of a handler that happen one after another, so that whichever one is in progress is ended however the handler returns
+	current trace.Span
+}
+
+func (stages *stageTracer) Next(ctx context.Context, name string) context.Context { // End the stage in progress and start the next one, returning the context for it
+	stages.End()
+	ctx, stages.current = tracer.Start(ctx, name)
+	return ctx
+}
+
+func (stages *stageTracer) End() {
+	if stages.current != nil {
+		stages.current.End()
+		stages.current = nil
+	}
+}
+
+func (stages *stageTracer) Fail(err error) { // Mark the stage in progress as failed
+	if stages.current != nil && err != nil {
+		stages.current.RecordError(err)
+		stages.current.SetStatus(codes.Error, redactError(err))
+	}
+}
+
+func withConnectionTracing(ctx context.Context) context.Context { // Trace the DNS lookups, connections and TLS handshakes of a request made with ctx
+	var mutex sync.Mutex // Connections to several addresses can be attempted at once (eg. IPv4 and IPv6), so every callback can run concurrently
+	var dnsSpan, tlsSpan trace.Span
+	connectSpans := make(map[string]trace.Span) // Spans of the connections in progress, by address
+	end := func(span trace.Span, err error) {
+		if span == nil {
+			return
+		}
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			_, span := tracer.Start(ctx, "dns", trace.WithAttributes(attribute.String("server.address", info.Host)))
+			mutex.Lock()
+			dnsSpan = span
+			mutex.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mutex.Lock()
+			span := dnsSpan
+			dnsSpan = nil
+			mutex.Unlock()
+			end(span, info.Err)
+		},
+		ConnectStart: func(network string, addr string) {
+			_, span := tracer.Start(ctx, "connect", trace.WithAttributes(attribute.String("network.peer.address", addr)))
+			mutex.Lock()
+			connectSpans[network+" "+addr] = span
+			mutex.Unlock()
+		},
+		ConnectDone: func(network string, addr string, err error) {
+			mutex.Lock()
+			span := connectSpans[network+" "+addr]
+			delete(connectSpans, network+" "+addr)
+			mutex.Unlock()
+			end(span, err)
+		},
+		TLSHandshakeStart: func() {
+			_, span := tracer.Start(ctx, "tls handshake")
+			mutex.Lock()
+			tlsSpan = span
+			mutex.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mutex.Lock()
+			span := tlsSpan
+			tlsSpan = nil
+			mutex.Unlock()
+			end(span, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			trace.SpanFromContext(ctx).AddEvent("got connection", trace.WithAttributes(attribute.Bool("reused", info.Reused)))
+		},
+		GotFirstResponseByte: func() {
+			trace.SpanFromContext(ctx).AddEvent("first response byte")
+		},
+	})
+}
+
+func injectTraceContext(ctx context.Context, request *http.Request) { // Pass the trace on to an upstream host, if trace-upstream says to
+	if config.TraceUpstream {
+		tracePropagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+	}
+}
+
+func traceResponse(ctx context.Context, response *http.Response) { // Note what an upstream host sent back on the span in ctx
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode), attribute.String("http.response.content_type", response.Header.Get("Content-Type")))
+	if response.ContentLength >= 0 {
+		span.SetAttributes(attribute.Int64("http.response.body.size", response.ContentLength))
+	}
+}
+
+type timedReader struct { // The timedReader type adds up the time spent reading from a reader, for stages that happen while another one is streaming
+	io.Reader
+	Elapsed time.Duration
+}
+
+func (reader *timedReader) Read(data []byte) (int, error) {
+	start := time.Now()
+	n, err := reader.Reader.Read(data)
+	reader.Elapsed += time.Since(start)
+	return n, err
+}
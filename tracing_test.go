@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptrace"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestConnectionTracingDualStack(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer func(saved trace.Tracer) { tracer = saved }(tracer)
+	tracer = provider.Tracer("test")
+
+	clientTrace := httptrace.ContextClientTrace(withConnectionTracing(context.Background()))
+	addrs := map[string]error{"[2001:db8::1]:443": errors.New("connection refused"), "192.0.2.1:443": nil}
+	var wg sync.WaitGroup
+	for addr := range addrs { // Happy Eyeballs dials both addresses at once
+		clientTrace.ConnectStart("tcp", addr)
+	}
+	for addr, err := range addrs {
+		wg.Add(1)
+		go func(addr string, err error) {
+			defer wg.Done()
+			clientTrace.ConnectDone("tcp", addr, err)
+		}(addr, err)
+	}
+	wg.Wait()
+
+	spans := exporter.GetSpans()
+	if len(spans) != len(addrs) {
+		t.Fatalf("got %d ended spans, want %d", len(spans), len(addrs))
+	}
+	for _, span := range spans {
+		var addr string
+		for _, attr := range span.Attributes {
+			if attr.Key == attribute.Key("network.peer.address") {
+				addr = attr.Value.AsString()
+			}
+		}
+		failed := span.Status.Code == codes.Error
+		if err, ok := addrs[addr]; !ok || failed != (err != nil) {
+			t.Errorf("span for %q has status %v", addr, span.Status)
+		}
+	}
+}
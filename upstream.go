@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type breakerState int // The breakerState type is the state of an upstream host's circuit breaker
+
+const (
+	breakerClosed   breakerState = iota // Requests go through as usual
+	breakerOpen                         // The host is failing, so requests fail straight away
+	breakerHalfOpen                     // The cooldown is over, and one request is let through to see if the host has recovered
+)
+
+func (state breakerState) String() string {
+	switch state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type hostGuard struct { // The hostGuard type limits the requests that are made to a single upstream host, and stops making them when it fails
+	Host  string        // The host (and port, if there is one) being guarded
+	slots chan struct{} // Semaphore for requests in progress, nil if there's no limit
+	mutex sync.Mutex
+
+	active   int       // Requests in progress, including ones whose responses are still being read
+	lastUsed time.Time // When a request to the host was last started, so that idle guards can be forgotten
+
+	state     breakerState
+	failures  int       // Consecutive timeouts and 5xx responses
+	openedAt  time.Time // When the breaker last opened
+	probing   bool      // Whether the request that decides if a half-open breaker closes is in progress
+	lastError string    // Why the last request failed, for the admin view
+}
+
+type hostStatus struct { // The hostStatus type is a snapshot of a hostGuard, for the admin view
+	Host      string
+	State     breakerState
+	Failures  int
+	Active    int       // Requests in progress
+	OpenedAt  time.Time // When the breaker last opened, or the zero time if it never has
+	LastError string
+}
+
+type breakerOpenError struct { // The breakerOpenError type is returned instead of making a request to a host whose breaker is open
+	Host       string
+	RetryAfter time.Duration // How long until the breaker lets a request through again
+}
+
+func (err *breakerOpenError) Error() string {
+	return "upstream: " + err.Host + " is failing, so requests to it are paused"
+}
+
+var errHostBusy = errors.New("upstream: too many requests to the host are already in progress")
+
+var upstreamClient *http.Client // Client for every request to upstream hosts, shared so that connections are reused
+
+func newUpstreamClient() *http.Client { // Make the client for upstream requests from the upstream flags
+	dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   config.TLSTimeout,
+		ResponseHeaderTimeout: config.HeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          config.IdleConns,
+		MaxIdleConnsPerHost:   config.IdleConnsPerHost,
+		IdleConnTimeout:       config.IdleTimeout,
+	}
+	go forgetIdleGuards()
+	return &http.Client{Transport: guardedTransport{transport}} // The total timeout comes from each request's context instead, so that it also ends when the client goes away
+}
+
+var upstreamGuards = make(map[string]*hostGuard) // Guards by host
+var upstreamGuardsMutex sync.Mutex
+
+const hostQueueTimeout = 30 * time.Second // How long a request waits for a free slot at a busy host before giving up
+
+const guardIdleTime = 10 * time.Minute // How long a host has to be idle for before its guard is forgotten
+
+func guardFor(host string) *hostGuard { // Get the guard for a host, making one if it hasn't been requested from recently
+	upstreamGuardsMutex.Lock()
+	defer upstreamGuardsMutex.Unlock()
+	guard := upstreamGuards[host]
+	if guard == nil {
+		guard = &hostGuard{Host: host}
+		if config.HostConcurrency > 0 {
+			guard.slots = make(chan struct{}, config.HostConcurrency)
+		}
+		upstreamGuards[host] = guard
+	}
+	guard.mutex.Lock()
+	guard.lastUsed = time.Now() // While upstreamGuardsMutex is held, so that forgetIdleGuards can't forget a guard that's about to be used
+	guard.mutex.Unlock()
+	return guard
+}
+
+func forgetIdleGuards() { // Forget the guards of hosts that haven't been requested from in a while and aren't failing, so that the map doesn't grow with every host ever requested
+	for range time.Tick(time.Minute) {
+		upstreamGuardsMutex.Lock()
+		for host, guard := range upstreamGuards {
+			guard.mutex.Lock()
+			if guard.state == breakerClosed && guard.active == 0 && time.Since(guard.lastUsed) > guardIdleTime {
+				delete(upstreamGuards, host)
+			}
+			guard.mutex.Unlock()
+		}
+		upstreamGuardsMutex.Unlock()
+	}
+}
+
+type guardedTransport struct { // The guardedTransport type is a RoundTripper that applies a hostGuard to every request, including each hop of a redirect
+	Base http.RoundTripper
+}
+
+func (transport guardedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	guard := guardFor(request.URL.Host)
+	err := guard.allow()
+	if err != nil {
+		return nil, err
+	}
+	err = guard.acquire(request.Context())
+	if err != nil {
+		guard.abandon()
+		return nil, err
+	}
+
+	start := time.Now()
+	response, err := transport.Base.RoundTrip(request)
+	if err != nil {
+		guard.release()
+		upstreamDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+	} else {
+		upstreamDuration.WithLabelValues(statusClass(response.StatusCode)).Observe(time.Since(start).Seconds())
+		response.Body = countingReader{&guardedBody{ReadCloser: response.Body, Guard: guard}} // The slot is held until the body has been read, since slow bodies are what tie hosts up
+	}
+	switch {
+	case err != nil && isTimeout(err):
+		guard.fail(err.Error())
+	case err != nil:
+		guard.abandon() // Other errors (like a refused connection) fail fast, so they don't tie anything up
+	case response.StatusCode >= 500:
+		guard.fail(response.Status)
+	default:
+		guard.succeed()
+	}
+	return response, err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func (guard *hostGuard) allow() error { // Check if a request can be made to the host, moving the breaker to half-open once the cooldown is over
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	switch guard.state {
+	case breakerOpen:
+		if wait := config.BreakerCooldown - time.Since(guard.openedAt); wait > 0 {
+			return &breakerOpenError{guard.Host, wait}
+		}
+		guard.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if guard.probing { // Only one request gets to find out if the host has recovered
+			return &breakerOpenError{guard.Host, time.Second}
+		}
+		guard.probing = true
+	}
+	return nil
+}
+
+func (guard *hostGuard) acquire(ctx context.Context) error { // Wait for a free slot at the host
+	if guard.slots != nil {
+		timer := time.NewTimer(hostQueueTimeout)
+		defer timer.Stop()
+		select {
+		case guard.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return errHostBusy
+		}
+	}
+	guard.mutex.Lock()
+	guard.active++
+	guard.mutex.Unlock()
+	return nil
+}
+
+func (guard *hostGuard) release() {
+	guard.mutex.Lock()
+	guard.active--
+	guard.mutex.Unlock()
+	if guard.slots != nil {
+		<-guard.slots
+	}
+}
+
+type guardedBody struct { // The guardedBody type releases a request's slot at its host once the response body is closed
+	io.ReadCloser
+	Guard *hostGuard
+	once  sync.Once
+}
+
+func (body *guardedBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.Guard.release)
+	return err
+}
+
+func (guard *hostGuard) fail(reason string) { // Record a timeout or 5xx response, opening the breaker if there have been too many in a row
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.failures++
+	guard.lastError = reason
+	guard.probing = false
+	if guard.state == breakerHalfOpen || (config.BreakerFailures > 0 && guard.failures >= config.BreakerFailures) {
+		if guard.state != breakerOpen {
+			guard.openedAt = time.Now()
+		}
+		guard.state = breakerOpen
+	}
+}
+
+func (guard *hostGuard) succeed() { // Record a response that wasn't a failure, closing the breaker
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.failures = 0
+	guard.probing = false
+	guard.state = breakerClosed
+}
+
+func (guard *hostGuard) abandon() { // Record a request that neither failed nor succeeded, so that a half-open breaker lets another one through
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.probing = false
+}
+
+func upstreamStatuses() []hostStatus { // Get a snapshot of every host that has been requested from recently, with failing hosts first
+	upstreamGuardsMutex.Lock()
+	guards := make([]*hostGuard, 0, len(upstreamGuards))
+	for _, guard := range upstreamGuards {
+		guards = append(guards, guard)
+	}
+	upstreamGuardsMutex.Unlock()
+
+	statuses := make([]hostStatus, 0, len(guards))
+	for _, guard := range guards {
+		guard.mutex.Lock()
+		statuses = append(statuses, hostStatus{Host: guard.Host, State: guard.state, Failures: guard.failures, Active: guard.active, OpenedAt: guard.openedAt, LastError: guard.lastError})
+		guard.mutex.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].State != statuses[j].State {
+			return statuses[i].State > statuses[j].State
+		}
+		return statuses[i].Host < statuses[j].Host
+	})
+	return statuses
+}
+
+var unavailablePage = template.Must(template.New("unavailable").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta content="width=device-width, initial-scale=1" name="viewport">
+    <title>{{.Host}} Isn't Responding</title>
+</head>
+<body style="font-family: Helvetica, Arial, sans-serif; margin: 10%">
+    <h1>{{.Host}} Isn't Responding</h1>
+    <p>Its last few requests timed out or failed, so Bypass is giving it a break. Try again in {{.Seconds}} seconds.</p>
+</body>
+</html>
+`))
+
+func serveUnavailable(resWriter http.ResponseWriter, openErr *breakerOpenError) { // Serve the page for a host whose breaker is open, without waiting on the host
+	seconds := int(openErr.RetryAfter.Seconds() + 1)
+	resWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resWriter.Header().Set("Retry-After", strconv.Itoa(seconds))
+	resWriter.WriteHeader(http.StatusServiceUnavailable)
+	unavailablePage.Execute(resWriter, struct {
+		Host    string
+		Seconds int
+	}{openErr.Host, seconds})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHostSlotHeldUntilBodyClosed(t *testing.T) {
+	defer func(concurrency int) { config.HostConcurrency = concurrency }(config.HostConcurrency)
+	config.HostConcurrency = 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(resWriter http.ResponseWriter, reqHTTP *http.Request) {
+		resWriter.Write([]byte("body"))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: guardedTransport{http.DefaultTransport}}
+
+	first, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	_, err = client.Do(request)
+	if err == nil {
+		t.Fatal("a second request got a slot while the first response's body was still open")
+	}
+
+	ioutil.ReadAll(first.Body)
+	first.Body.Close()
+	first.Body.Close() // Closing twice mustn't free two slots
+	second, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("a request didn't get a slot once the first response's body was closed: %v", err)
+	}
+	second.Body.Close()
+	if guard := guardFor(request.URL.Host); guard.active != 0 || len(guard.slots) != 0 {
+		t.Errorf("%d requests (and %d slots) are still active", guard.active, len(guard.slots))
+	}
+}
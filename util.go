@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
@@ -37,41 +36,71 @@ func parseContentType(rawcontype string) (*contentType, error) { // Parse a MIME
 	return &conType, nil
 }
 
-func formatURI(rawurl string, host string, baseurl string) (string, error) { // Formats a non-absolute URL or one with missing information into a hopefully valid one
-	parsedurl, err := url.Parse(rawurl)
+type linkBase struct { // The linkBase type holds what formatURI needs to know about the client that formatted URLs are for
+	ExternalURL string // External URL of the proxy, that formatted URLs point back to
+	Session     string // ID of the client's session, which encrypted URLs are bound to
+}
+
+func formatURI(rawurl string, host string, link *linkBase) (string, error) { // Formats a non-absolute URL or one with missing information into a hopefully valid one
+	if strings.HasPrefix(strings.TrimSpace(rawurl), "#") { // Links within the same document already work
+		return rawurl, nil
+	}
+	parsedurl, err := url.Parse(cleanURL(rawurl))
 	if err != nil {
 		return "", errors.New("main: couldn't parse provided URL in order to format it")
 	}
-	if parsedurl.IsAbs() {
-		if !strings.HasPrefix(parsedurl.Scheme, "http") && parsedurl.Scheme != "data" { // We use the prefix because it http and https are valid
-			parsedurl.Scheme = "http"
-		} else if parsedurl.Scheme == "data" { // Don't touch base64 encoded data URIs
-			return rawurl, nil
-		}
-	} else {
+	if !parsedurl.IsAbs() {
 		base, err := url.Parse(host)
 		if err != nil {
 			return "", errors.New("main: couldn't parse provided host ( \"base\" ) in order to resolve a reference")
 		}
-		// We don't need to check for data URIs here because they should be interpreted as absolute
-		if !strings.HasPrefix(parsedurl.Scheme, "http") {
-			base.Scheme = "http"
-		}
 		parsedurl = base.ResolveReference(parsedurl)
-		if !strings.HasPrefix(parsedurl.Scheme, "http") {
+	}
+	err = normalizeHost(parsedurl)
+	if err != nil {
+		return "", err
+	}
+	switch schemePolicyFor(parsedurl.Scheme) {
+	case schemePass:
+		return rawurl, nil
+	case schemeNeutralize:
+		return neutralizedURL, nil
+	case schemeProxy:
+		if !strings.HasPrefix(parsedurl.Scheme, "http") { // We use the prefix because it http and https are valid
 			parsedurl.Scheme = "http"
 		}
+	} // Blocked URLs still go through the proxy, so that the user finds out why they don't work
+	return proxiedURL(parsedurl.String(), link)
+}
+
+func proxiedURL(target string, link *linkBase) (string, error) { // Make the URL that the proxy serves target from
+	var fragment string
+	if i := strings.IndexByte(target, '#'); i >= 0 { // The fragment is kept outside of the encoded URL so that the browser can see it, since it's never sent to the server anyway
+		target, fragment = target[:i], target[i:]
+	}
+	encodedurl, err := codec.Encode(target, link.Session)
+	if err != nil {
+		return "", err
 	}
-	encodedurl := base64.StdEncoding.EncodeToString([]byte(parsedurl.String()))
-	parsedProxyHost, err := url.Parse(baseurl)
+	parsedProxyHost, err := url.Parse(link.ExternalURL)
 	if err != nil {
 		return "", errors.New("main: couldn't parse provided base url")
 	}
-	parsedProxyHost.Path += "/p/"
-	q := parsedProxyHost.Query()
-	q.Add("u", encodedurl)
-	parsedProxyHost.RawQuery = q.Encode()
-	return parsedProxyHost.String(), nil
+	if config.IsolateOrigins {
+		parsedtarget, err := url.Parse(target)
+		if err != nil {
+			return "", err
+		}
+		if !parsedtarget.IsAbs() { // Typed in without a scheme, which proxyHandler assumes is http
+			parsedtarget, err = url.Parse("http://" + target)
+			if err != nil {
+				return "", err
+			}
+		}
+		parsedProxyHost.Host = isolatedHost(parsedProxyHost.Host, parsedtarget)
+	}
+	parsedProxyHost.Path = externalPath(link.ExternalURL) + "p/"
+	return parsedProxyHost.String() + encodedurl + fragment, nil
 }
 
 func isAllowedURL(targetURL *url.URL) error {
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strings"
+)
+
+type urlFormatter func(rawurl string, host string, link *linkBase) (string, error) // URL formatters have the same signature as formatURI
+
+type xmlRewriter struct { // The xmlRewriter type rewrites the URLs in an XML document, while keeping everything else byte-for-byte
+	BaseURL       string          // URL of the document being rewritten, used to resolve relative URLs
+	Link          *linkBase       // Where rewritten URLs point back to
+	URLAttributes map[string]bool // Local names of attributes that hold URLs
+	URLElements   map[string]bool // Local names of elements whose text is a URL
+	BaseElements  map[string]bool // Local names of elements whose text is the base URL for the rest of their parent (eg. DASH's BaseURL)
+	Format        urlFormatter    // Function used to format URLs, formatURI if nil
+}
+
+type xmlElement struct { // The xmlElement type holds an open element and the base URL that applies inside of it
+	Name    string // Local name of the element
+	BaseURL string // Base URL of the element, after applying any xml:base attributes
+}
+
+var feedURLAttributes = map[string]bool{ // Attributes that hold URLs in RSS, Atom and their common extensions
+	"href": true, "src": true, "url": true,
+}
+
+var feedURLElements = map[string]bool{ // Elements whose text is a URL in RSS, Atom, sitemaps and their common extensions
+	"link": true, "loc": true, "url": true, "comments": true, "docs": true, "icon": true, "logo": true, "uri": true,
+	"commentRss": true, "content_loc": true, "player_loc": true, "thumbnail_loc": true,
+}
+
+func modifyXML(body string, baseURL string, link *linkBase) (string, error) { // Modify the URLs in RSS and Atom feeds, sitemaps and other XML documents
+	rewriter := &xmlRewriter{BaseURL: baseURL, Link: link, URLAttributes: feedURLAttributes, URLElements: feedURLElements}
+	return rewriter.Rewrite(body)
+}
+
+func (rw *xmlRewriter) Rewrite(body string) (string, error) { // Rewrite an XML document, copying every token that doesn't change exactly as it was
+	decoder := xml.NewDecoder(strings.NewReader(body))
+	decoder.Entity = xml.HTMLEntity // Feeds are often written by hand and use HTML entities
+	var buf bytes.Buffer
+	stack := []xmlElement{{BaseURL: rw.BaseURL}}
+	var last int64 // Offset of the end of the last token
+	for {
+		token, err := decoder.RawToken() // Namespace prefixes are kept as they are, so that we can write tags back out
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		offset := decoder.InputOffset()
+		raw := body[last:offset]
+		last = offset
+
+		parent := stack[len(stack)-1]
+		switch tok := token.(type) {
+		case xml.StartElement:
+			element := xmlElement{Name: tok.Name.Local, BaseURL: parent.BaseURL}
+			for _, attr := range tok.Attr {
+				if attr.Name.Space == "xml" && attr.Name.Local == "base" {
+					element.BaseURL = resolveXMLBase(element.BaseURL, attr.Value)
+				}
+			}
+			stack = append(stack, element)
+			if rw.rewriteAttrs(tok.Attr, element.BaseURL) {
+				writeXMLStartElement(&buf, tok, strings.HasSuffix(raw, "/>")) // The decoder gives us an end element for self-closing tags, but it has no raw text of its own
+				continue
+			}
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if rw.BaseElements[parent.Name] && len(stack) > 2 && strings.TrimSpace(string(tok)) != "" {
+				stack[len(stack)-2].BaseURL = resolveXMLBase(stack[len(stack)-2].BaseURL, string(tok))
+			}
+			if rw.URLElements[parent.Name] {
+				text := string(tok)
+				trimmed := strings.TrimSpace(text)
+				if formatted, ok := rw.rewriteText(trimmed, parent.BaseURL); ok {
+					start := strings.Index(text, trimmed)
+					buf.WriteString(text[:start]) // Only the URL is escaped, since EscapeText would turn the whitespace around it into character references
+					xml.EscapeText(&buf, []byte(formatted))
+					buf.WriteString(text[start+len(trimmed):])
+					continue
+				}
+			}
+		}
+		buf.WriteString(raw)
+	}
+	return buf.String(), nil
+}
+
+func (rw *xmlRewriter) rewriteAttrs(attrs []xml.Attr, baseURL string) bool { // Rewrite URL attributes in place, reporting whether any changed
+	modified := false
+	for i, attr := range attrs {
+		if !rw.URLAttributes[attr.Name.Local] || attr.Name.Space == "xmlns" {
+			continue
+		}
+		formatted, err := rw.format(attr.Value, baseURL)
+		if err == nil && formatted != attr.Value {
+			attrs[i].Value = formatted
+			modified = true
+		}
+	}
+	return modified
+}
+
+func (rw *xmlRewriter) rewriteText(trimmed string, baseURL string) (string, bool) { // Rewrite the URL that an element's text (with the whitespace around it trimmed) is made of
+	if trimmed == "" || strings.ContainsAny(trimmed, " \t\r\n<") { // Not a URL
+		return "", false
+	}
+	formatted, err := rw.format(trimmed, baseURL)
+	if err != nil {
+		return "", false
+	}
+	return formatted, true
+}
+
+func (rw *xmlRewriter) format(rawurl string, baseURL string) (string, error) {
+	if rw.Format != nil {
+		return rw.Format(rawurl, baseURL, rw.Link)
+	}
+	return formatURI(rawurl, baseURL, rw.Link)
+}
+
+func resolveXMLBase(baseURL string, xmlBase string) string { // Resolve an xml:base attribute against the base URL that was already in effect
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return baseURL
+	}
+	ref, err := url.Parse(strings.TrimSpace(xmlBase))
+	if err != nil {
+		return baseURL
+	}
+	return base.ResolveReference(ref).String()
+}
+
+func writeXMLStartElement(buf *bytes.Buffer, element xml.StartElement, selfClosing bool) { // Write a start tag from a raw token, keeping namespace prefixes
+	buf.WriteByte('<')
+	buf.WriteString(xmlName(element.Name))
+	for _, attr := range element.Attr {
+		buf.WriteByte(' ')
+		buf.WriteString(xmlName(attr.Name))
+		buf.WriteString(`="`)
+		xml.EscapeText(buf, []byte(attr.Value))
+		buf.WriteByte('"')
+	}
+	if selfClosing {
+		buf.WriteByte('/')
+	}
+	buf.WriteByte('>')
+}
+
+func xmlName(name xml.Name) string { // Format a raw token's name, where Space is the namespace prefix
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
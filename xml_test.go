@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestModifyXML(t *testing.T) {
+	feed := `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom">
+  <channel>
+    <atom:link href="/feed.xml" rel="self"/>
+    <link>
+      https://example.com/
+    </link>
+    <item>
+	<link>post?a=1&amp;b=2</link>
+      <description>Not a &lt;URL&gt;</description>
+    </item>
+  </channel>
+</rss>`
+	rewritten, err := modifyXML(feed, "https://example.com/blog/", testLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<atom:link href="` + testProxied("https://example.com/feed.xml") + `" rel="self"/>`,
+		"<link>\n      " + testProxied("https://example.com/") + "\n    </link>", // The whitespace around the URL is kept as it was
+		"\t<link>" + testProxied("https://example.com/blog/post?a=1&b=2") + "</link>",
+		`<description>Not a &lt;URL&gt;</description>`,
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+	} {
+		if !strings.Contains(rewritten, want) {
+			t.Errorf("rewritten feed doesn't contain %q:\n%s", want, rewritten)
+		}
+	}
+	if strings.Contains(rewritten, "&#x") {
+		t.Errorf("rewritten feed has character references that weren't in the original:\n%s", rewritten)
+	}
+}
+
+func TestModifyXMLUnchanged(t *testing.T) {
+	sitemap := "<?xml version=\"1.0\"?>\n<urlset xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n  <!-- Nothing here -->\n  <note a='1'>Text &amp; more</note>\n</urlset>\n"
+	rewritten, err := modifyXML(sitemap, "https://example.com/", testLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != sitemap {
+		t.Errorf("got %q, want %q", rewritten, sitemap)
+	}
+}